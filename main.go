@@ -22,7 +22,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/joho/godotenv"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -65,24 +64,58 @@ func fallbackEnv(envString string, fallback string) string {
 }
 
 func main() {
-	if err := pkg.NewRedis(); err != nil {
+	if err := pkg.NewStore(); err != nil {
 		panic(err)
 	}
 
+	// Upgrade timeouts stored by older versions before anything reads them
+	dryRun := os.Getenv("MIGRATIONS_DRY_RUN") == "true"
+	if err := pkg.Migrate(dryRun); err != nil {
+		panic(err)
+	}
+
+	if dryRun {
+		logrus.Info("Dry run of the migrations finished, exiting...")
+		_ = pkg.Store.Close()
+		return
+	}
+
+	enableMetrics := pkg.SetupMetrics()
+
+	// Load the API tokens clients authenticate with, and who is allowed to connect
+	pkg.NewTokens()
+	pkg.NewAccessControl()
+
 	// Create a new `Server` instance
 	pkg.NewServer()
 
-	enableMetrics := pkg.SetupMetrics()
+	// Create the scheduler that applies timeouts once they expire, and re-arm
+	// everything that was pending before we went down
+	pkg.NewScheduler()
+	if err := pkg.Scheduler.Rehydrate(); err != nil {
+		panic(err)
+	}
+
+	pkg.Scheduler.Start()
 
 	http.HandleFunc("/", pkg.HandleRequest)
+	http.HandleFunc("/v1/timeouts", pkg.HandleTimeoutsAPI)
+	http.HandleFunc("/v1/timeouts/", pkg.HandleTimeoutAPI)
+	http.HandleFunc("/health", pkg.HandleHealth)
 
 	if enableMetrics {
 		http.HandleFunc("/metrics", promhttp.Handler().ServeHTTP)
 	}
 
+	tlsConfig, err := pkg.NewTLS()
+	if err != nil {
+		panic(err)
+	}
+
 	server := &http.Server{
-		Addr:    fmt.Sprintf(":%s", fallbackEnv(os.Getenv("PORT"), "4025")),
-		Handler: nil,
+		Addr:      fmt.Sprintf(":%s", fallbackEnv(os.Getenv("PORT"), "4025")),
+		Handler:   nil,
+		TLSConfig: tlsConfig,
 	}
 
 	// Setup syscall signals for Docker
@@ -91,8 +124,15 @@ func main() {
 
 	go func() {
 		// Run the server
-		logrus.Infof("Now listening at 0.0.0.0:%s", fallbackEnv(os.Getenv("PORT"), "4025"))
-		err := server.ListenAndServe()
+		var err error
+		if tlsConfig != nil {
+			logrus.Infof("Now listening at 0.0.0.0:%s with TLS", fallbackEnv(os.Getenv("PORT"), "4025"))
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			logrus.Infof("Now listening at 0.0.0.0:%s", fallbackEnv(os.Getenv("PORT"), "4025"))
+			err = server.ListenAndServe()
+		}
+
 		if err != nil && err != http.ErrServerClosed {
 			logrus.Fatalf("Error has occured while listening to server: %v", err)
 		}
@@ -113,23 +153,11 @@ func main() {
 
 	// :spin:
 	defer func() {
-		// Save server queue before closing
-		data, err := json.Marshal(pkg.Server.Queue)
-		if err != nil {
-			logrus.Fatalf("Unable to deserialize server queue into JSON: %v", err)
-		} else {
-			logrus.Info("Saving server queue...")
-			err := pkg.Redis.Connection.Set(context.TODO(), "nino:timeouts", string(data), 0).Err()
-			if err != nil {
-				logrus.Fatalf("Unable to save server queue: %s", err)
-			}
-
-			logrus.Info("Saved server queue!")
-		}
+		pkg.Scheduler.Stop()
 
-		err = pkg.Redis.Connection.Close()
+		err := pkg.Store.Close()
 		if err != nil {
-			logrus.Fatalf("Unable to close Redis server: %v", err)
+			logrus.Fatalf("Unable to close the store: %v", err)
 		}
 
 		// Now we cancel! ^w^
@@ -138,7 +166,7 @@ func main() {
 
 	// Kill off the server
 	if err := server.Shutdown(shutdownCtx); err != nil {
-		logrus.Fatal("Unable to shutdown server: %v", err)
+		logrus.Fatalf("Unable to shutdown server: %v", err)
 		os.Exit(1)
 	} else {
 		logrus.Info("Goodbye...")
@@ -0,0 +1,307 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var Access *AccessControl
+
+// AccessControl decides which requests are let in, based on the `ALLOWED_ORIGINS` and
+// `ALLOWED_IPS` allowlists, and limits how often an IP can connect or send API requests
+// and how many connections it can have open.
+type AccessControl struct {
+	origins    []string
+	networks   []*net.IPNet
+	trustProxy bool
+	proxies    []*net.IPNet
+
+	mutex          *sync.Mutex
+	connections    map[string]int
+	limiters       map[string]*ipLimiter
+	connectRate    rate.Limit
+	connectBurst   int
+	requestRate    rate.Limit
+	requestBurst   int
+	maxConnections int
+	messageRate    rate.Limit
+	messageBurst   int
+}
+
+type ipLimiter struct {
+	connect  *rate.Limiter
+	request  *rate.Limiter
+	lastSeen time.Time
+}
+
+func NewAccessControl() {
+	if Access != nil {
+		panic("Attempt to initialise another access control instance!")
+	}
+
+	// A rate of 0 would reject everything, so only the number of open connections can be unlimited
+	connectsPerMinute := envPositiveInt("CONNECTIONS_PER_MINUTE", 30)
+	requestsPerMinute := envPositiveInt("REQUESTS_PER_MINUTE", 120)
+	messagesPerSecond := envPositiveInt("MESSAGES_PER_SECOND", 50)
+	Access = &AccessControl{
+		trustProxy:     os.Getenv("TRUST_PROXY") == "true",
+		mutex:          &sync.Mutex{},
+		connections:    map[string]int{},
+		limiters:       map[string]*ipLimiter{},
+		connectRate:    rate.Limit(float64(connectsPerMinute) / 60),
+		connectBurst:   connectsPerMinute,
+		requestRate:    rate.Limit(float64(requestsPerMinute) / 60),
+		requestBurst:   requestsPerMinute,
+		maxConnections: envInt("MAX_CONNECTIONS_PER_IP", 10),
+		messageRate:    rate.Limit(messagesPerSecond),
+		messageBurst:   envPositiveInt("MESSAGE_BURST", 2*messagesPerSecond),
+	}
+
+	for _, origin := range strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			Access.origins = append(Access.origins, origin)
+		}
+	}
+
+	Access.networks = parseNetworks("ALLOWED_IPS")
+	Access.proxies = parseNetworks("TRUSTED_PROXIES")
+}
+
+// parseNetworks parses the comma-separated IPs and CIDR ranges in the environment variable.
+func parseNetworks(name string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		if !strings.Contains(value, "/") {
+			if strings.Contains(value, ":") {
+				value += "/128"
+			} else {
+				value += "/32"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			logrus.Fatalf("Unable to parse `%s` in `%s`: %v", value, name, err)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks
+}
+
+func containsIP(networks []*net.IPNet, value string) bool {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientIP returns the IP the request came from. Behind a trusted proxy, it's read from
+// `X-Forwarded-For`, which proxies append to, so only the right-most entries can be
+// trusted. The header is walked from the right, skipping the `TRUSTED_PROXIES`, and the
+// first other address is the client. Without `TRUSTED_PROXIES`, only the proxy we're
+// connected to is trusted, so it's the right-most entry. An entry that isn't an IP can't
+// be the client, so the last proxy before it is used instead.
+func (a *AccessControl) ClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	if !a.trustProxy || (len(a.proxies) > 0 && !containsIP(a.proxies, host)) {
+		return host
+	}
+
+	var forwarded []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+
+	last := host
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		entry := strings.TrimSpace(forwarded[i])
+		if entry == "" {
+			continue
+		}
+
+		ip := parseForwardedIP(entry)
+		if ip == "" {
+			return last
+		}
+
+		if !containsIP(a.proxies, ip) {
+			return ip
+		}
+
+		last = ip
+	}
+
+	return last
+}
+
+// parseForwardedIP returns the IP of an `X-Forwarded-For` entry, which some proxies
+// send with a port, or an empty string if it isn't one.
+func parseForwardedIP(entry string) string {
+	if host, _, err := net.SplitHostPort(entry); err == nil {
+		entry = host
+	}
+
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return ""
+	}
+
+	return ip.String()
+}
+
+// AllowedOrigin returns if the `Origin` header is allowed. Requests without one (like
+// from bots) are always allowed, otherwise it must be in `ALLOWED_ORIGINS`.
+func (a *AccessControl) AllowedOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, allowed := range a.origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowedIP returns if the IP is in `ALLOWED_IPS`, every IP is allowed if it's empty.
+func (a *AccessControl) AllowedIP(ip string) bool {
+	return len(a.networks) == 0 || containsIP(a.networks, ip)
+}
+
+// limiterFor returns the limiters of the IP, and forgets the ones of IPs that weren't
+// seen in a while. It must be called with the mutex held.
+func (a *AccessControl) limiterFor(ip string, now time.Time) *ipLimiter {
+	for other, entry := range a.limiters {
+		if now.Sub(entry.lastSeen) > 10*time.Minute && a.connections[other] == 0 {
+			delete(a.limiters, other)
+		}
+	}
+
+	entry, ok := a.limiters[ip]
+	if !ok {
+		entry = &ipLimiter{
+			connect: rate.NewLimiter(a.connectRate, a.connectBurst),
+			request: rate.NewLimiter(a.requestRate, a.requestBurst),
+		}
+
+		a.limiters[ip] = entry
+	}
+
+	entry.lastSeen = now
+	return entry
+}
+
+// Connect reserves a connection for the IP, and returns the reason it was rejected if
+// it connects too often or has too many open connections. It's checked before the
+// token, so clients can't guess tokens faster than they can connect.
+func (a *AccessControl) Connect(ip string) (bool, string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	if !a.limiterFor(ip, now).connect.AllowN(now, 1) {
+		return false, "connection_rate"
+	}
+
+	if a.maxConnections > 0 && a.connections[ip] >= a.maxConnections {
+		return false, "connection_limit"
+	}
+
+	a.connections[ip]++
+	return true, ""
+}
+
+// Request returns if the IP can send another API request. Like `Connect`, it's checked
+// before the token.
+func (a *AccessControl) Request(ip string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	return a.limiterFor(ip, now).request.AllowN(now, 1)
+}
+
+// Disconnect releases a connection reserved with `Connect`.
+func (a *AccessControl) Disconnect(ip string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.connections[ip] <= 1 {
+		delete(a.connections, ip)
+	} else {
+		a.connections[ip]--
+	}
+}
+
+// MessageLimiter returns a limiter for the messages of a single client.
+func (a *AccessControl) MessageLimiter() *rate.Limiter {
+	return rate.NewLimiter(a.messageRate, a.messageBurst)
+}
+
+// Reject records why a request was rejected.
+func (a *AccessControl) Reject(reason string) {
+	if MetricsEnabled {
+		RejectionMetric.WithLabelValues(reason).Inc()
+	}
+}
+
+// redact replaces a secret with a short hash, so bad keys can be told apart in the logs
+// without revealing any of them.
+func redact(secret string) string {
+	if secret == "" {
+		return "<empty>"
+	}
+
+	sum := sha256.Sum256([]byte(secret))
+	return "sha256:" + hex.EncodeToString(sum[:4])
+}
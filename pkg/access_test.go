@@ -0,0 +1,100 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		trust     bool
+		proxies   string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"untrusted proxy", false, "", "1.1.1.1:1234", []string{"2.2.2.2"}, "1.1.1.1"},
+		{"no header", true, "", "1.1.1.1:1234", nil, "1.1.1.1"},
+		{"right-most entry", true, "", "1.1.1.1:1234", []string{"6.6.6.6, 2.2.2.2"}, "2.2.2.2"},
+		{"many headers", true, "", "1.1.1.1:1234", []string{"6.6.6.6", "2.2.2.2"}, "2.2.2.2"},
+		{"trusted remote", true, "10.0.0.0/8", "10.0.0.1:1234", []string{"6.6.6.6, 2.2.2.2, 10.0.0.2"}, "2.2.2.2"},
+		{"untrusted remote", true, "10.0.0.0/8", "1.1.1.1:1234", []string{"2.2.2.2"}, "1.1.1.1"},
+		{"only proxies", true, "10.0.0.0/8", "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"empty entries", true, "10.0.0.0/8", "10.0.0.1:1234", []string{", 2.2.2.2,, 10.0.0.2, "}, "2.2.2.2"},
+		{"garbage entry", true, "10.0.0.0/8", "10.0.0.1:1234", []string{"2.2.2.2, garbage, 10.0.0.2"}, "10.0.0.2"},
+		{"garbage only", true, "", "1.1.1.1:1234", []string{"garbage"}, "1.1.1.1"},
+		{"entry with port", true, "", "1.1.1.1:1234", []string{"2.2.2.2:5678"}, "2.2.2.2"},
+		{"ipv6 entry", true, "", "1.1.1.1:1234", []string{"[2001:db8::1]:5678"}, "2001:db8::1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("TEST_PROXIES", test.proxies)
+			access := &AccessControl{trustProxy: test.trust, proxies: parseNetworks("TEST_PROXIES")}
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = test.remote
+			for _, value := range test.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+
+			if got := access.ClientIP(req); got != test.want {
+				t.Errorf("ClientIP() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	secret := "super-secret-api-key"
+	redacted := redact(secret)
+	if strings.Contains(redacted, secret[:4]) {
+		t.Errorf("redact() = %q, leaks the start of the secret", redacted)
+	}
+
+	if redacted != redact(secret) || redacted == redact(secret+"!") {
+		t.Errorf("redact() should tell secrets apart")
+	}
+}
+
+func TestAccessControlRates(t *testing.T) {
+	for _, key := range []string{"CONNECTIONS_PER_MINUTE", "REQUESTS_PER_MINUTE", "MESSAGES_PER_SECOND", "MESSAGE_BURST", "MAX_CONNECTIONS_PER_IP"} {
+		t.Setenv(key, "0")
+	}
+
+	previous := Access
+	Access = nil
+	t.Cleanup(func() { Access = previous })
+
+	NewAccessControl()
+	if Access.connectBurst != 30 || Access.requestBurst != 120 || Access.messageRate != 50 || Access.messageBurst != 100 {
+		t.Errorf("NewAccessControl() with rates of 0 = %d connections, %d requests, %v messages and a burst of %d, want the defaults",
+			Access.connectBurst, Access.requestBurst, Access.messageRate, Access.messageBurst)
+	}
+
+	if Access.maxConnections != 0 {
+		t.Errorf("NewAccessControl() with MAX_CONNECTIONS_PER_IP=0 allows %d connections, want unlimited", Access.maxConnections)
+	}
+}
@@ -0,0 +1,388 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxBodySize limits how large the body of a request can be, timeouts are much smaller
+const maxBodySize = 1 << 20
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		logrus.Errorf("Unable to write HTTP response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, toErrorResponse(err))
+}
+
+// writeStoreError responds to a failed storage operation, with a 503 if the storage is
+// unavailable so clients know to retry, or a 202 if the write was buffered until it's back.
+func writeStoreError(w http.ResponseWriter, err error, message string) {
+	if errors.Is(err, ErrWriteBuffered) {
+		writeError(w, http.StatusAccepted, err)
+		return
+	}
+
+	if errors.Is(err, ErrStoreUnavailable) {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	writeError(w, http.StatusInternalServerError, newError(ErrorInternal, "", message))
+}
+
+// admitted checks the request against the origin and IP allowlists.
+func admitted(w http.ResponseWriter, req *http.Request) bool {
+	ip := Access.ClientIP(req)
+	if !Access.AllowedOrigin(req) {
+		Access.Reject("origin")
+		logrus.Warnf("Rejected request from %s, origin %s isn't allowed", ip, req.Header.Get("Origin"))
+		writeError(w, http.StatusForbidden, newError(ErrorForbidden, "", "Origin not allowed"))
+
+		return false
+	}
+
+	if !Access.AllowedIP(ip) {
+		Access.Reject("ip")
+		logrus.Warnf("Rejected request from %s, IP isn't allowed", ip)
+		writeError(w, http.StatusForbidden, newError(ErrorForbidden, "", "IP not allowed"))
+
+		return false
+	}
+
+	return true
+}
+
+// requestToken returns the token of the `Authorization` header, or of the client
+// certificate if there is no header, and the secret that was sent.
+func requestToken(req *http.Request) (*Token, string) {
+	secret := req.Header.Get(authHeader)
+	if secret != "" {
+		return Tokens.Authenticate(secret), secret
+	}
+
+	return Tokens.ForCertificate(peerCertificate(req)), ""
+}
+
+func rejectAuth(w http.ResponseWriter, req *http.Request, secret string) {
+	Access.Reject("auth")
+	logrus.Warnf("Rejected request from %s, received bad authentication key (header=%s)", Access.ClientIP(req), redact(secret))
+	writeError(w, http.StatusUnauthorized, newError(ErrorUnauthorized, "", "Missing or invalid authorization"))
+}
+
+// allowed checks the request against the origin and IP allowlists and the request rate
+// limit, and authenticates it with the `Authorization` header or the client certificate.
+func allowed(w http.ResponseWriter, req *http.Request) *Token {
+	if !admitted(w, req) {
+		return nil
+	}
+
+	if ip := Access.ClientIP(req); !Access.Request(ip) {
+		Access.Reject("request_rate")
+		logrus.Warnf("Rejected request from %s (request_rate)", ip)
+		writeError(w, http.StatusTooManyRequests, newError(ErrorRateLimited, "", "Too many requests"))
+
+		return nil
+	}
+
+	token, secret := requestToken(req)
+	if token == nil {
+		rejectAuth(w, req, secret)
+		return nil
+	}
+
+	return token
+}
+
+// authorized checks that the request is allowed and has a valid token with the given scope.
+func authorized(w http.ResponseWriter, req *http.Request, scope string) bool {
+	token := allowed(w, req)
+	if token == nil {
+		return false
+	}
+
+	if !Tokens.Use(token, scope, fmt.Sprintf("%s %s", req.Method, req.URL.Path)) {
+		writeError(w, http.StatusForbidden, newError(ErrorForbidden, "", fmt.Sprintf("Token is missing the `%s` scope", scope)))
+		return false
+	}
+
+	return true
+}
+
+func methodScope(method string) string {
+	if method == http.MethodGet || method == http.MethodHead {
+		return ScopeRead
+	}
+
+	return ScopeWrite
+}
+
+// HandleTimeoutsAPI serves `GET /v1/timeouts` to list pending timeouts, filtered by the
+// `guild_id`, `user_id`, `type` and `moderator_id` query parameters and paginated with
+// `offset` and `limit`, and `POST /v1/timeouts` to create one.
+func HandleTimeoutsAPI(w http.ResponseWriter, req *http.Request) {
+	if !authorized(w, req, methodScope(req.Method)) {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		{
+			query := req.URL.Query()
+			q := QueryRequest{
+				GuildId:     query.Get("guild_id"),
+				UserId:      query.Get("user_id"),
+				Type:        query.Get("type"),
+				ModeratorId: query.Get("moderator_id"),
+			}
+
+			for field, value := range map[string]*int{"offset": &q.Offset, "limit": &q.Limit} {
+				if query.Get(field) == "" {
+					continue
+				}
+
+				parsed, err := strconv.Atoi(query.Get(field))
+				if err != nil {
+					writeError(w, http.StatusBadRequest, newError(ErrorInvalidField, field, fmt.Sprintf("`%s` must be an integer", field)))
+					return
+				}
+
+				*value = parsed
+			}
+
+			if err := validateQuery(q); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+
+			res, err := Scheduler.Query(q)
+			if err != nil {
+				logrus.Errorf("Unable to query timeouts: %v", err)
+				writeStoreError(w, err, "Unable to retrieve timeouts")
+
+				return
+			}
+
+			writeJSON(w, http.StatusOK, res)
+		}
+
+	case http.MethodPost:
+		{
+			var body interface{}
+			if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxBodySize)).Decode(&body); err != nil {
+				writeError(w, http.StatusBadRequest, newError(ErrorInvalidPayload, "", fmt.Sprintf("Unable to decode timeout: %v", err)))
+				return
+			}
+
+			var t Timeout
+			if err := decodeData(body, &t); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+
+			// Ids are always assigned by us
+			t.Id = ""
+			if err := validateTimeout(t); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+
+			stored, err := Scheduler.Schedule(t)
+			if err != nil {
+				logrus.Errorf("Unable to store timeout %v into Redis: %v", t, err)
+				writeStoreError(w, err, "Unable to store timeout")
+
+				return
+			}
+
+			writeJSON(w, http.StatusCreated, stored)
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, newError(ErrorMethodNotAllowed, "", "Method not allowed"))
+	}
+}
+
+// HandleTimeoutAPI serves `GET /v1/timeouts/{id}` and `GET /v1/timeouts/{guild}/{user}`
+// to inspect pending timeouts, and `DELETE` on the same paths to cancel them. The `type`
+// query parameter can be used to only cancel a specific type of the user's timeouts.
+func HandleTimeoutAPI(w http.ResponseWriter, req *http.Request) {
+	if !authorized(w, req, methodScope(req.Method)) {
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/v1/timeouts/"), "/"), "/")
+	for _, part := range parts {
+		if part == "" {
+			writeError(w, http.StatusNotFound, newError(ErrorNotFound, "", "Not found"))
+			return
+		}
+	}
+
+	switch {
+	case len(parts) == 1:
+		handleTimeoutById(w, req, parts[0])
+
+	case len(parts) == 2:
+		handleTimeoutsByUser(w, req, parts[0], parts[1])
+
+	default:
+		writeError(w, http.StatusNotFound, newError(ErrorNotFound, "", "Not found"))
+	}
+}
+
+func handleTimeoutById(w http.ResponseWriter, req *http.Request, id string) {
+	switch req.Method {
+	case http.MethodGet:
+		{
+			t, err := Scheduler.Get(id)
+			if err != nil {
+				logrus.Errorf("Unable to retrieve timeout %s: %v", id, err)
+				writeStoreError(w, err, "Unable to retrieve timeout")
+
+				return
+			}
+
+			if t == nil {
+				writeError(w, http.StatusNotFound, newError(ErrorNotFound, "", "Timeout not found"))
+				return
+			}
+
+			writeJSON(w, http.StatusOK, t)
+		}
+
+	case http.MethodDelete:
+		{
+			cancelled, err := Scheduler.Cancel(id)
+			if err != nil {
+				logrus.Errorf("Unable to cancel timeout %s: %v", id, err)
+				writeStoreError(w, err, "Unable to cancel timeout")
+
+				return
+			}
+
+			if !cancelled {
+				writeError(w, http.StatusNotFound, newError(ErrorNotFound, "", "Timeout not found"))
+				return
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, newError(ErrorMethodNotAllowed, "", "Method not allowed"))
+	}
+}
+
+func handleTimeoutsByUser(w http.ResponseWriter, req *http.Request, guildId string, userId string) {
+	if err := validateSnowflake("guild_id", guildId); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := validateSnowflake("user_id", userId); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	kind := req.URL.Query().Get("type")
+	switch req.Method {
+	case http.MethodGet:
+		{
+			res, err := Scheduler.Query(QueryRequest{
+				GuildId: guildId,
+				UserId:  userId,
+				Type:    kind,
+				Limit:   maxQueryLimit,
+			})
+
+			if err != nil {
+				logrus.Errorf("Unable to retrieve timeouts (guild=%s; user=%s): %v", guildId, userId, err)
+				writeStoreError(w, err, "Unable to retrieve timeouts")
+
+				return
+			}
+
+			if res.Total == 0 {
+				writeError(w, http.StatusNotFound, newError(ErrorNotFound, "", "Timeout not found"))
+				return
+			}
+
+			writeJSON(w, http.StatusOK, res.Timeouts)
+		}
+
+	case http.MethodDelete:
+		{
+			cancelled, err := Scheduler.CancelFor(guildId, userId, kind)
+			if err != nil {
+				logrus.Errorf("Unable to cancel timeout (type=%s; guild=%s; user=%s): %v", kind, guildId, userId, err)
+				writeStoreError(w, err, "Unable to cancel timeout")
+
+				return
+			}
+
+			if !cancelled {
+				writeError(w, http.StatusNotFound, newError(ErrorNotFound, "", "Timeout not found"))
+				return
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, newError(ErrorMethodNotAllowed, "", "Method not allowed"))
+	}
+}
+
+// HandleHealth handles `/health`, which answers with a 503 while the storage is degraded.
+// It doesn't need authentication, so it doesn't include the error.
+func HandleHealth(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, newError(ErrorMethodNotAllowed, "", "Method not allowed"))
+		return
+	}
+
+	stats := StorageStatus()
+	stats.Error = ""
+
+	status, code := "ok", http.StatusOK
+	if stats.Degraded {
+		status, code = "degraded", http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, code, map[string]interface{}{
+		"status":  status,
+		"storage": stats,
+	})
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"encoding/json"
+	"golang.org/x/time/rate"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// The users of the timeouts `newTestAPI` stores, besides `testUserId`.
+const (
+	testOtherUserId   = "300000000000000000"
+	testMissingUserId = "400000000000000000"
+)
+
+// userPath is the path of the timeouts of the user in `testGuildId`.
+func userPath(userId string) string {
+	return "/v1/timeouts/" + testGuildId + "/" + userId
+}
+
+// newTestAPI serves the API from the store, with a `reader`, `writer` and `admin` token
+// whose secrets are their names.
+func newTestAPI(t *testing.T, store TimeoutStore) {
+	access, tokens, scheduler, previous := Access, Tokens, Scheduler, Store
+	t.Cleanup(func() {
+		Access, Tokens, Scheduler, Store = access, tokens, scheduler, previous
+	})
+
+	t.Setenv("AUTH", "")
+	var write func(data string)
+	Tokens, write = newTestTokens(t)
+	write(`[
+		{"name": "reader", "token": "reader", "scopes": ["timeouts:read"]},
+		{"name": "writer", "token": "writer", "scopes": ["timeouts:write"]},
+		{"name": "admin", "token": "admin", "scopes": ["admin"]}
+	]`)
+
+	Tokens.Reload()
+	Access = &AccessControl{
+		mutex:        &sync.Mutex{},
+		connections:  map[string]int{},
+		limiters:     map[string]*ipLimiter{},
+		requestRate:  rate.Inf,
+		requestBurst: 1,
+	}
+
+	Scheduler = &TimeoutScheduler{}
+	Store = store
+	for _, timeout := range []Timeout{
+		testTimeout("a", testGuildId, testUserId, "mute", 100),
+		testTimeout("b", testGuildId, testUserId, "ban", 100),
+		testTimeout("c", testGuildId, testOtherUserId, "mute", 100),
+	} {
+		if _, _, err := Store.Store(timeout); err != nil {
+			t.Fatalf("Store() error = %v", err)
+		}
+	}
+}
+
+// serveAPI sends the request to the handler `main.go` routes its path to.
+func serveAPI(method string, target string, secret string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if secret != "" {
+		req.Header.Set("Authorization", secret)
+	}
+
+	w := httptest.NewRecorder()
+	if req.URL.Path == "/v1/timeouts" {
+		HandleTimeoutsAPI(w, req)
+	} else {
+		HandleTimeoutAPI(w, req)
+	}
+
+	return w
+}
+
+// responseCode returns the error code of the response, if it has one.
+func responseCode(w *httptest.ResponseRecorder) ErrorCode {
+	var res ErrorResponse
+	_ = json.Unmarshal(w.Body.Bytes(), &res)
+	return res.Code
+}
+
+func TestTimeoutAPI(t *testing.T) {
+	valid, _ := json.Marshal(validTimeout())
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		secret   string
+		body     string
+		want     int
+		wantCode ErrorCode
+	}{
+		{"get by id", "GET", "/v1/timeouts/a", "reader", "", http.StatusOK, ""},
+		{"get missing id", "GET", "/v1/timeouts/missing", "reader", "", http.StatusNotFound, ErrorNotFound},
+		{"get by user", "GET", userPath(testUserId), "reader", "", http.StatusOK, ""},
+		{"get by user of type", "GET", userPath(testUserId) + "?type=ban", "reader", "", http.StatusOK, ""},
+		{"get user without timeouts", "GET", userPath(testMissingUserId), "reader", "", http.StatusNotFound, ErrorNotFound},
+		{"get by invalid guild", "GET", "/v1/timeouts/1/" + testUserId, "reader", "", http.StatusBadRequest, ErrorInvalidField},
+		{"get by invalid user", "GET", userPath("someone"), "reader", "", http.StatusBadRequest, ErrorInvalidField},
+		{"trailing slash", "GET", "/v1/timeouts/a/", "reader", "", http.StatusOK, ""},
+		{"no id", "GET", "/v1/timeouts/", "reader", "", http.StatusNotFound, ErrorNotFound},
+		{"empty segment", "GET", "/v1/timeouts/1//2", "reader", "", http.StatusNotFound, ErrorNotFound},
+		{"too many segments", "GET", "/v1/timeouts/1/2/3", "reader", "", http.StatusNotFound, ErrorNotFound},
+		{"cancel by id", "DELETE", "/v1/timeouts/a", "writer", "", http.StatusNoContent, ""},
+		{"cancel missing id", "DELETE", "/v1/timeouts/missing", "writer", "", http.StatusNotFound, ErrorNotFound},
+		{"cancel by user", "DELETE", userPath(testUserId), "writer", "", http.StatusNoContent, ""},
+		{"cancel by invalid user", "DELETE", userPath("1"), "writer", "", http.StatusBadRequest, ErrorInvalidField},
+		{"cancel missing type", "DELETE", userPath(testOtherUserId) + "?type=ban", "writer", "", http.StatusNotFound, ErrorNotFound},
+		{"unknown method by id", "PUT", "/v1/timeouts/a", "writer", "", http.StatusMethodNotAllowed, ErrorMethodNotAllowed},
+		{"unknown method by user", "PATCH", userPath(testUserId), "writer", "", http.StatusMethodNotAllowed, ErrorMethodNotAllowed},
+		{"list", "GET", "/v1/timeouts?guild_id=" + testGuildId + "&limit=2", "reader", "", http.StatusOK, ""},
+		{"list with a bad limit", "GET", "/v1/timeouts?limit=many", "reader", "", http.StatusBadRequest, ErrorInvalidField},
+		{"create", "POST", "/v1/timeouts", "writer", string(valid), http.StatusCreated, ""},
+		{"create invalid", "POST", "/v1/timeouts", "writer", `{"type": "mute"}`, http.StatusBadRequest, ErrorInvalidField},
+		{"create undecodable", "POST", "/v1/timeouts", "writer", `{`, http.StatusBadRequest, ErrorInvalidPayload},
+		{"create too large", "POST", "/v1/timeouts", "writer", `{"reason": "` + strings.Repeat("a", maxBodySize) + `"}`, http.StatusBadRequest, ErrorInvalidPayload},
+		{"unknown method on list", "PUT", "/v1/timeouts", "writer", "", http.StatusMethodNotAllowed, ErrorMethodNotAllowed},
+		{"no token", "GET", "/v1/timeouts/a", "", "", http.StatusUnauthorized, ErrorUnauthorized},
+		{"wrong token", "GET", "/v1/timeouts/a", "wrong", "", http.StatusUnauthorized, ErrorUnauthorized},
+		{"read without read scope", "GET", "/v1/timeouts/a", "writer", "", http.StatusForbidden, ErrorForbidden},
+		{"head without read scope", "HEAD", "/v1/timeouts/a", "writer", "", http.StatusForbidden, ErrorForbidden},
+		{"cancel without write scope", "DELETE", "/v1/timeouts/a", "reader", "", http.StatusForbidden, ErrorForbidden},
+		{"create without write scope", "POST", "/v1/timeouts", "reader", string(valid), http.StatusForbidden, ErrorForbidden},
+		{"admin reads", "GET", "/v1/timeouts/a", "admin", "", http.StatusOK, ""},
+		{"admin writes", "DELETE", "/v1/timeouts/a", "admin", "", http.StatusNoContent, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newTestAPI(t, newMemoryStore())
+			w := serveAPI(test.method, test.target, test.secret, test.body)
+			if w.Code != test.want {
+				t.Errorf("%s %s = %d, want %d: %s", test.method, test.target, w.Code, test.want, w.Body.String())
+			}
+
+			if code := responseCode(w); code != test.wantCode {
+				t.Errorf("%s %s error code = %q, want %q", test.method, test.target, code, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestTimeoutAPICancels(t *testing.T) {
+	newTestAPI(t, newMemoryStore())
+	if w := serveAPI("DELETE", userPath(testUserId)+"?type=ban", "writer", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d, want %d", w.Code, http.StatusNoContent)
+	}
+
+	var timeouts []Timeout
+	w := serveAPI("GET", userPath(testUserId), "reader", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &timeouts); err != nil || len(timeouts) != 1 || timeouts[0].Id != "a" {
+		t.Errorf("GET after cancelling the ban = %s, want only a", w.Body.String())
+	}
+
+	if w := serveAPI("DELETE", userPath(testUserId), "writer", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d, want %d", w.Code, http.StatusNoContent)
+	}
+
+	if w := serveAPI("GET", userPath(testUserId), "reader", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET after cancelling every type = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestTimeoutAPIDegraded(t *testing.T) {
+	valid, _ := json.Marshal(validTimeout())
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		body     string
+		want     int
+		wantCode ErrorCode
+	}{
+		{"create", "POST", "/v1/timeouts", string(valid), http.StatusAccepted, ErrorBuffered},
+		{"cancel by id", "DELETE", "/v1/timeouts/a", "", http.StatusAccepted, ErrorBuffered},
+		{"cancel by user", "DELETE", userPath(testUserId), "", http.StatusAccepted, ErrorBuffered},
+		{"get by id", "GET", "/v1/timeouts/a", "", http.StatusServiceUnavailable, ErrorUnavailable},
+		{"get by user", "GET", userPath(testUserId), "", http.StatusServiceUnavailable, ErrorUnavailable},
+		{"list", "GET", "/v1/timeouts", "", http.StatusServiceUnavailable, ErrorUnavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := &flakyStore{MemoryStore: newMemoryStore()}
+			newTestAPI(t, newTestBufferedStore(t, backend, filepath.Join(t.TempDir(), "wal")))
+
+			// The next write notices the store is gone
+			atomic.StoreInt32(&backend.down, 1)
+			if _, err := Scheduler.Schedule(testTimeout("d", "1", "4", "mute", 100)); err == nil {
+				t.Fatalf("Schedule() succeeded while the store is down")
+			}
+
+			w := serveAPI(test.method, test.target, "admin", test.body)
+			if w.Code != test.want {
+				t.Errorf("%s %s = %d, want %d: %s", test.method, test.target, w.Code, test.want, w.Body.String())
+			}
+
+			if code := responseCode(w); code != test.wantCode {
+				t.Errorf("%s %s error code = %q, want %q", test.method, test.target, code, test.wantCode)
+			}
+		})
+	}
+}
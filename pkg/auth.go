@@ -0,0 +1,290 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	ScopeRead  = "timeouts:read"
+	ScopeWrite = "timeouts:write"
+	ScopeAdmin = "admin"
+)
+
+// Token is a named API token. Tokens are only valid between `not_before` and `expires_at`
+// (if set), so a new token can be added before the old one expires to rotate them
+// without downtime.
+type Token struct {
+	Name      string     `json:"name"`
+	Secret    string     `json:"token"`
+	Scopes    []string   `json:"scopes"`
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Allows returns if the token has the given scope, `admin` has every scope.
+func (t *Token) Allows(scope string) bool {
+	for _, other := range t.Scopes {
+		if other == scope || other == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Valid returns if the token is within its validity window.
+func (t *Token) Valid(now time.Time) bool {
+	if t.NotBefore != nil && now.Before(*t.NotBefore) {
+		return false
+	}
+
+	return t.ExpiresAt == nil || now.Before(*t.ExpiresAt)
+}
+
+var Tokens *TokenStore
+
+// TokenStore holds the API tokens, loaded from the `AUTH` environment variable (as an
+// admin token named `default`), the JSON file in `TOKENS_FILE` and the `<prefix>:tokens`
+// hash in Redis (if it's the storage backend). They are reloaded every
+// `TOKENS_RELOAD_INTERVAL`.
+type TokenStore struct {
+	mutex  *sync.RWMutex
+	tokens []*Token
+	file   string
+}
+
+func NewTokens() {
+	if Tokens != nil {
+		panic("Attempt to initialise another token store!")
+	}
+
+	Tokens = &TokenStore{
+		mutex: &sync.RWMutex{},
+		file:  os.Getenv("TOKENS_FILE"),
+	}
+
+	Tokens.Reload()
+	go func() {
+		ticker := time.NewTicker(envPositiveDuration("TOKENS_RELOAD_INTERVAL", 30*time.Second))
+		defer ticker.Stop()
+
+		for range ticker.C {
+			Tokens.Reload()
+		}
+	}()
+}
+
+func readTokensFile(path string) ([]*Token, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []*Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+func (s *TokenStore) loaded() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.tokens != nil
+}
+
+// Reload loads every token again. If a source can't be read, the current tokens are
+// kept so a broken file doesn't lock everyone out.
+func (s *TokenStore) Reload() {
+	var tokens []*Token
+	if secret := os.Getenv("AUTH"); secret != "" {
+		tokens = append(tokens, &Token{
+			Name:   "default",
+			Secret: secret,
+			Scopes: []string{ScopeAdmin},
+		})
+	}
+
+	if s.file != "" {
+		fromFile, err := readTokensFile(s.file)
+		if err != nil {
+			logrus.Errorf("Unable to read tokens from %s: %v", s.file, err)
+			if s.loaded() {
+				return
+			}
+		}
+
+		tokens = append(tokens, fromFile...)
+	}
+
+	// Tokens can only be stored in Redis when it's used as the storage backend
+	var data map[string]string
+	if Redis != nil {
+		var err error
+		data, err = Redis.Connection.HGetAll(context.TODO(), Redis.Keys.tokens).Result()
+		if err != nil {
+			logrus.Errorf("Unable to retrieve tokens from Redis: %v", err)
+			if s.loaded() {
+				return
+			}
+		}
+	}
+
+	for name, value := range data {
+		var token Token
+		if err := json.Unmarshal([]byte(value), &token); err != nil {
+			logrus.Warnf("Unable to decode token %s from Redis, skipping", name)
+			continue
+		}
+
+		if token.Name == "" {
+			token.Name = name
+		}
+
+		tokens = append(tokens, &token)
+	}
+
+	valid := []*Token{}
+	for _, token := range tokens {
+		// Scopes and usage are tracked by name, and certificates are matched by it
+		if token.Name == "" {
+			logrus.Warnf("Skipping token without a name")
+			continue
+		}
+
+		valid = append(valid, token)
+	}
+
+	s.mutex.Lock()
+	changed := len(valid) != len(s.tokens)
+	s.tokens = valid
+	s.mutex.Unlock()
+
+	if changed {
+		logrus.Infof("Loaded %d API tokens", len(valid))
+	}
+}
+
+// Authenticate returns the currently valid token with the given secret, or `nil`.
+func (s *TokenStore) Authenticate(secret string) *Token {
+	// Tokens without a secret can only be used with a client certificate
+	if secret == "" {
+		return nil
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	now := time.Now()
+	var found *Token
+	for _, token := range s.tokens {
+		// Compare against every token, so timing doesn't tell which one matched
+		if subtle.ConstantTimeCompare([]byte(token.Secret), []byte(secret)) == 1 && token.Valid(now) && found == nil {
+			found = token
+		}
+	}
+
+	return found
+}
+
+// ForCertificate returns the currently valid token named after the common name of a
+// verified client certificate, or `nil`.
+func (s *TokenStore) ForCertificate(certificate *x509.Certificate) *Token {
+	if certificate == nil || certificate.Subject.CommonName == "" {
+		return nil
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	now := time.Now()
+	for _, token := range s.tokens {
+		if token.Name == certificate.Subject.CommonName && token.Valid(now) {
+			return token
+		}
+	}
+
+	return nil
+}
+
+// Current returns the currently loaded version of the token, or `nil` if it was removed,
+// its secret changed or it isn't valid anymore. Connections hold on to their token, so
+// they have to check it again to notice it was revoked.
+func (s *TokenStore) Current(token *Token) *Token {
+	if token == nil {
+		return nil
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	now := time.Now()
+	for _, other := range s.tokens {
+		if other.Name == token.Name && other.Secret == token.Secret && other.Valid(now) {
+			return other
+		}
+	}
+
+	return nil
+}
+
+// Use checks that the token is still loaded, valid and has the scope, and records its usage.
+func (s *TokenStore) Use(token *Token, scope string, action string) bool {
+	name := "<none>"
+	if token != nil {
+		name = token.Name
+	}
+
+	token = s.Current(token)
+	allowed := token != nil && token.Allows(scope)
+
+	if MetricsEnabled {
+		TokenUsageMetric.With(prometheus.Labels{"token": name, "scope": scope, "allowed": boolLabel(allowed)}).Inc()
+	}
+
+	if allowed {
+		logrus.Debugf("Token %s used for %s", name, action)
+	} else {
+		logrus.Warnf("Token %s isn't allowed to use %s (missing scope %s or expired)", name, action, scope)
+	}
+
+	return allowed
+}
+
+func boolLabel(value bool) string {
+	if value {
+		return "true"
+	}
+
+	return "false"
+}
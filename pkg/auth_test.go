@@ -0,0 +1,190 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenAllows(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		scope  string
+		want   bool
+	}{
+		{nil, ScopeRead, false},
+		{[]string{ScopeRead}, ScopeRead, true},
+		{[]string{ScopeRead}, ScopeWrite, false},
+		{[]string{ScopeRead, ScopeWrite}, ScopeWrite, true},
+		{[]string{ScopeAdmin}, ScopeWrite, true},
+		{[]string{ScopeWrite}, ScopeAdmin, false},
+	}
+
+	for _, test := range tests {
+		token := &Token{Name: "test", Scopes: test.scopes}
+		if got := token.Allows(test.scope); got != test.want {
+			t.Errorf("Allows(%s) with %v = %v, want %v", test.scope, test.scopes, got, test.want)
+		}
+	}
+}
+
+func TestTokenValid(t *testing.T) {
+	now := time.Now()
+	before := now.Add(-time.Hour)
+	after := now.Add(time.Hour)
+	tests := []struct {
+		name      string
+		notBefore *time.Time
+		expiresAt *time.Time
+		want      bool
+	}{
+		{"no window", nil, nil, true},
+		{"started", &before, nil, true},
+		{"not started", &after, nil, false},
+		{"not expired", nil, &after, true},
+		{"expired", nil, &before, false},
+		{"within window", &before, &after, true},
+		{"expires now", nil, &now, false},
+	}
+
+	for _, test := range tests {
+		token := &Token{Name: "test", NotBefore: test.notBefore, ExpiresAt: test.expiresAt}
+		if got := token.Valid(now); got != test.want {
+			t.Errorf("%s: Valid() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// newTestTokens returns a token store reading the tokens file, which is written
+// with `write`.
+func newTestTokens(t *testing.T) (*TokenStore, func(data string)) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatalf("Unable to write the tokens file: %v", err)
+		}
+	}
+
+	return &TokenStore{mutex: &sync.RWMutex{}, file: path}, write
+}
+
+func TestTokensReload(t *testing.T) {
+	t.Setenv("AUTH", "default-secret")
+	tokens, write := newTestTokens(t)
+	write(`[
+		{"name": "reader", "token": "reader-secret", "scopes": ["timeouts:read"]},
+		{"name": "writer", "token": "writer-secret", "scopes": ["timeouts:write"]},
+		{"name": "expired", "token": "expired-secret", "scopes": ["admin"], "expires_at": "2000-01-01T00:00:00Z"},
+		{"token": "nameless-secret", "scopes": ["admin"]}
+	]`)
+
+	tokens.Reload()
+	if token := tokens.Authenticate("default-secret"); token == nil || token.Name != "default" || !token.Allows(ScopeAdmin) {
+		t.Errorf("Authenticate(AUTH) = %+v, want the default admin token", token)
+	}
+
+	reader := tokens.Authenticate("reader-secret")
+	if reader == nil || reader.Name != "reader" {
+		t.Fatalf("Authenticate(reader) = %+v, want the reader token", reader)
+	}
+
+	writer := tokens.Authenticate("writer-secret")
+	if writer == nil || writer.Name != "writer" {
+		t.Fatalf("Authenticate(writer) = %+v, want the writer token", writer)
+	}
+
+	for _, secret := range []string{"", "wrong", "expired-secret", "nameless-secret"} {
+		if token := tokens.Authenticate(secret); token != nil {
+			t.Errorf("Authenticate(%q) = %+v, want nil", secret, token)
+		}
+	}
+
+	// A broken file keeps the current tokens
+	write(`[{"name": "broken"`)
+	tokens.Reload()
+	if tokens.Current(reader) == nil || tokens.Current(writer) == nil {
+		t.Errorf("Current() = nil after a broken reload, want the tokens to be kept")
+	}
+
+	// The writer is revoked and the reader's secret is rotated
+	write(`[
+		{"name": "reader", "token": "rotated-secret", "scopes": ["timeouts:read", "timeouts:write"]}
+	]`)
+
+	tokens.Reload()
+	if token := tokens.Current(writer); token != nil {
+		t.Errorf("Current(writer) = %+v after it was removed, want nil", token)
+	}
+
+	if token := tokens.Current(reader); token != nil {
+		t.Errorf("Current(reader) = %+v after its secret changed, want nil", token)
+	}
+
+	if token := tokens.Authenticate("reader-secret"); token != nil {
+		t.Errorf("Authenticate(old secret) = %+v, want nil", token)
+	}
+
+	rotated := tokens.Authenticate("rotated-secret")
+	if rotated == nil || !rotated.Allows(ScopeWrite) {
+		t.Errorf("Authenticate(rotated) = %+v, want the reloaded reader token", rotated)
+	}
+}
+
+func TestTokensUse(t *testing.T) {
+	tokens, write := newTestTokens(t)
+	write(`[
+		{"name": "reader", "token": "reader-secret", "scopes": ["timeouts:read"]},
+		{"name": "admin", "token": "admin-secret", "scopes": ["admin"]}
+	]`)
+
+	tokens.Reload()
+	reader := tokens.Authenticate("reader-secret")
+	admin := tokens.Authenticate("admin-secret")
+	tests := []struct {
+		name  string
+		token *Token
+		scope string
+		want  bool
+	}{
+		{"no token", nil, ScopeRead, false},
+		{"reader reads", reader, ScopeRead, true},
+		{"reader writes", reader, ScopeWrite, false},
+		{"admin writes", admin, ScopeWrite, true},
+		{"unknown token", &Token{Name: "reader", Secret: "forged", Scopes: []string{ScopeAdmin}}, ScopeRead, false},
+	}
+
+	for _, test := range tests {
+		if got := tokens.Use(test.token, test.scope, "testing"); got != test.want {
+			t.Errorf("%s: Use(%s) = %v, want %v", test.name, test.scope, got, test.want)
+		}
+	}
+
+	// Connections keep their token, so the loaded scopes are checked instead of its own
+	write(`[{"name": "reader", "token": "reader-secret", "scopes": []}]`)
+	tokens.Reload()
+	if tokens.Use(reader, ScopeRead, "testing") {
+		t.Errorf("Use() = true after the scope was removed, want false")
+	}
+}
@@ -0,0 +1,611 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+var (
+	timeoutsBucket   = []byte("timeouts")
+	scheduleBucket   = []byte("schedule")
+	uniqueBucket     = []byte("unique")
+	deliveriesBucket = []byte("deliveries")
+	deadlinesBucket  = []byte("deadlines")
+	queueBucket      = []byte("queue")
+)
+
+// BoltStore keeps everything in a single bbolt file, so the service can run without Redis.
+// Timeouts are keyed by id, and scheduled with keys of their big-endian `ExpiresAt` followed
+// by their id so they're ordered by when they expire. Queries scan every timeout, which is
+// fine for the amount of timeouts a single bot has.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+type boltDelivery struct {
+	Timeout  Timeout `json:"timeout"`
+	Attempt  int     `json:"attempt"`
+	Deadline int64   `json:"deadline"`
+}
+
+func newBoltStore(path string) (*BoltStore, error) {
+	logrus.Infof("Opening the timeouts database at %s...", path)
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{timeoutsBucket, scheduleBucket, uniqueBucket, deliveriesBucket, deadlinesBucket, queueBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// orderedKey prefixes the id with the big-endian time, so keys are sorted by it.
+func orderedKey(at int64, id string) []byte {
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(at))
+	return append(key, id...)
+}
+
+func uniqueKey(t Timeout) []byte {
+	return []byte(t.GuildId + ":" + t.UserId + ":" + t.Type)
+}
+
+func getTimeout(tx *bolt.Tx, id string) (*Timeout, error) {
+	data := tx.Bucket(timeoutsBucket).Get([]byte(id))
+	if data == nil {
+		return nil, nil
+	}
+
+	var t Timeout
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func putTimeout(tx *bolt.Tx, t Timeout) error {
+	data, err := json.Marshal(&t)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Bucket(timeoutsBucket).Put([]byte(t.Id), data); err != nil {
+		return err
+	}
+
+	if err := tx.Bucket(scheduleBucket).Put(orderedKey(t.ExpiresAt, t.Id), nil); err != nil {
+		return err
+	}
+
+	return tx.Bucket(uniqueBucket).Put(uniqueKey(t), []byte(t.Id))
+}
+
+func deleteTimeout(tx *bolt.Tx, t Timeout) error {
+	if err := tx.Bucket(timeoutsBucket).Delete([]byte(t.Id)); err != nil {
+		return err
+	}
+
+	if err := tx.Bucket(scheduleBucket).Delete(orderedKey(t.ExpiresAt, t.Id)); err != nil {
+		return err
+	}
+
+	unique := tx.Bucket(uniqueBucket)
+	if string(unique.Get(uniqueKey(t))) == t.Id {
+		return unique.Delete(uniqueKey(t))
+	}
+
+	return nil
+}
+
+func getDelivery(tx *bolt.Tx, id string) (*boltDelivery, error) {
+	data := tx.Bucket(deliveriesBucket).Get([]byte(id))
+	if data == nil {
+		return nil, nil
+	}
+
+	var delivery boltDelivery
+	if err := json.Unmarshal(data, &delivery); err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+func putDelivery(tx *bolt.Tx, id string, delivery boltDelivery) error {
+	data, err := json.Marshal(&delivery)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Bucket(deliveriesBucket).Put([]byte(id), data); err != nil {
+		return err
+	}
+
+	return tx.Bucket(deadlinesBucket).Put(orderedKey(delivery.Deadline, id), nil)
+}
+
+// dueKeys returns the ids of up to `limit` entries of an ordered bucket up to `now`.
+func dueKeys(bucket *bolt.Bucket, now int64, limit int) []string {
+	ids := []string{}
+	cursor := bucket.Cursor()
+	for key, _ := cursor.First(); key != nil && len(ids) < limit; key, _ = cursor.Next() {
+		if int64(binary.BigEndian.Uint64(key[:8])) > now {
+			break
+		}
+
+		ids = append(ids, string(key[8:]))
+	}
+
+	return ids
+}
+
+func (b *BoltStore) Store(t Timeout) (Timeout, bool, error) {
+	replaced := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		// Replace the existing timeout of the same type
+		if id := tx.Bucket(uniqueBucket).Get(uniqueKey(t)); id != nil {
+			t.Id = string(id)
+		}
+
+		old, err := getTimeout(tx, t.Id)
+		if err != nil {
+			return err
+		}
+
+		if old != nil {
+			replaced = true
+			if err := deleteTimeout(tx, *old); err != nil {
+				return err
+			}
+		}
+
+		return putTimeout(tx, t)
+	})
+
+	return t, replaced, err
+}
+
+func (b *BoltStore) Get(id string) (*Timeout, error) {
+	var t *Timeout
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		t, err = getTimeout(tx, id)
+		return err
+	})
+
+	return t, err
+}
+
+func (b *BoltStore) Find(q QueryRequest) ([]Timeout, error) {
+	timeouts := []Timeout{}
+	err := b.Scan(1000, func(batch []Timeout) error {
+		for _, t := range batch {
+			if matches(t, q) {
+				timeouts = append(timeouts, t)
+			}
+		}
+
+		return nil
+	})
+
+	return timeouts, err
+}
+
+// Page walks the schedule, which is ordered by when timeouts expire, so only the
+// timeouts on the page are decoded when there are no filters.
+func (b *BoltStore) Page(q QueryRequest) (QueryResponse, error) {
+	filtered := q.GuildId != "" || q.UserId != "" || q.Type != "" || q.ModeratorId != ""
+	page := QueryResponse{Timeouts: []Timeout{}, Offset: q.Offset}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(scheduleBucket).Cursor()
+		for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+			onPage := page.Total >= q.Offset && len(page.Timeouts) < q.Limit
+			if !filtered && !onPage {
+				page.Total++
+				continue
+			}
+
+			t, err := getTimeout(tx, string(key[8:]))
+			if err != nil {
+				logrus.Warnf("Unable to decode stored timeout %s, skipping", key[8:])
+				continue
+			}
+
+			if t == nil || !matches(*t, q) {
+				continue
+			}
+
+			if onPage {
+				page.Timeouts = append(page.Timeouts, *t)
+			}
+
+			page.Total++
+		}
+
+		return nil
+	})
+
+	return page, err
+}
+
+func (b *BoltStore) Scan(size int, fn func(timeouts []Timeout) error) error {
+	// Read every batch in its own transaction, so writes aren't blocked while `fn` runs
+	var after []byte
+	for {
+		var batch []Timeout
+		err := b.db.View(func(tx *bolt.Tx) error {
+			cursor := tx.Bucket(timeoutsBucket).Cursor()
+			key, value := cursor.First()
+			if after != nil {
+				key, value = cursor.Seek(after)
+				if key != nil && bytes.Equal(key, after) {
+					key, value = cursor.Next()
+				}
+			}
+
+			for ; key != nil && len(batch) < size; key, value = cursor.Next() {
+				after = append(after[:0], key...)
+
+				var t Timeout
+				if err := json.Unmarshal(value, &t); err != nil {
+					logrus.Warnf("Unable to decode stored timeout %s, skipping", key)
+					continue
+				}
+
+				batch = append(batch, t)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := fn(batch); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *BoltStore) Count() (int, error) {
+	count := 0
+	err := b.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(timeoutsBucket).Stats().KeyN
+		return nil
+	})
+
+	return count, err
+}
+
+func (b *BoltStore) Cancel(id string) (bool, error) {
+	cancelled := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		t, err := getTimeout(tx, id)
+		if err != nil || t == nil {
+			return err
+		}
+
+		cancelled = true
+		return deleteTimeout(tx, *t)
+	})
+
+	return cancelled, err
+}
+
+func (b *BoltStore) Update(id string, change func(t Timeout) (Timeout, error)) (*Timeout, *Timeout, error) {
+	var before, after *Timeout
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		t, err := getTimeout(tx, id)
+		if err != nil || t == nil {
+			return err
+		}
+
+		updated, err := change(*t)
+		if err != nil {
+			return err
+		}
+
+		if err := deleteTimeout(tx, *t); err != nil {
+			return err
+		}
+
+		if err := putTimeout(tx, updated); err != nil {
+			return err
+		}
+
+		before, after = t, &updated
+		return nil
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return before, after, nil
+}
+
+func (b *BoltStore) Due(now int64, limit int) ([]string, error) {
+	var ids []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		ids = dueKeys(tx.Bucket(scheduleBucket), now, limit)
+		return nil
+	})
+
+	return ids, err
+}
+
+func (b *BoltStore) Claim(id string, now int64, deliveryId string, deadline int64) (*Timeout, error) {
+	var claimed *Timeout
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		t, err := getTimeout(tx, id)
+		if err != nil || t == nil || t.ExpiresAt > now {
+			return err
+		}
+
+		if err := deleteTimeout(tx, *t); err != nil {
+			return err
+		}
+
+		claimed = t
+		return putDelivery(tx, deliveryId, boltDelivery{Timeout: *t, Attempt: 1, Deadline: deadline})
+	})
+
+	return claimed, err
+}
+
+func (b *BoltStore) Unacknowledged(now int64, limit int) ([]Delivery, error) {
+	var deliveries []Delivery
+	err := b.db.View(func(tx *bolt.Tx) error {
+		for _, id := range dueKeys(tx.Bucket(deadlinesBucket), now, limit) {
+			delivery, err := getDelivery(tx, id)
+			if err != nil {
+				return err
+			}
+
+			if delivery != nil {
+				deliveries = append(deliveries, Delivery{
+					Timeout:    delivery.Timeout,
+					DeliveryId: id,
+					Attempt:    delivery.Attempt,
+				})
+			}
+		}
+
+		return nil
+	})
+
+	return deliveries, err
+}
+
+// rearm moves the deadline of a delivery, if it's still pending.
+func rearm(tx *bolt.Tx, deliveryId string, deadline int64) error {
+	delivery, err := getDelivery(tx, deliveryId)
+	if err != nil || delivery == nil {
+		return err
+	}
+
+	if err := tx.Bucket(deadlinesBucket).Delete(orderedKey(delivery.Deadline, deliveryId)); err != nil {
+		return err
+	}
+
+	delivery.Deadline = deadline
+	return putDelivery(tx, deliveryId, *delivery)
+}
+
+func (b *BoltStore) Redeliver(deliveryId string, now int64, backoff time.Duration, maxBackoff time.Duration) (*Delivery, error) {
+	var redelivered *Delivery
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		delivery, err := getDelivery(tx, deliveryId)
+		if err != nil || delivery == nil || delivery.Deadline > now {
+			return err
+		}
+
+		if err := tx.Bucket(deadlinesBucket).Delete(orderedKey(delivery.Deadline, deliveryId)); err != nil {
+			return err
+		}
+
+		delivery.Attempt++
+		delivery.Deadline = backoffFor(now, delivery.Attempt, backoff, maxBackoff)
+		if err := putDelivery(tx, deliveryId, *delivery); err != nil {
+			return err
+		}
+
+		redelivered = &Delivery{
+			Timeout:    delivery.Timeout,
+			DeliveryId: deliveryId,
+			Attempt:    delivery.Attempt,
+		}
+
+		return nil
+	})
+
+	return redelivered, err
+}
+
+func (b *BoltStore) Ack(deliveryId string) (bool, error) {
+	acked := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if _, err := dequeue(tx, deliveryId); err != nil {
+			return err
+		}
+
+		delivery, err := getDelivery(tx, deliveryId)
+		if err != nil || delivery == nil {
+			return err
+		}
+
+		if err := tx.Bucket(deadlinesBucket).Delete(orderedKey(delivery.Deadline, deliveryId)); err != nil {
+			return err
+		}
+
+		acked = true
+		return tx.Bucket(deliveriesBucket).Delete([]byte(deliveryId))
+	})
+
+	return acked, err
+}
+
+// dequeue removes the delivery from the queue, by going through the whole queue since
+// it's usually short.
+func dequeue(tx *bolt.Tx, deliveryId string) (bool, error) {
+	queue := tx.Bucket(queueBucket)
+	cursor := queue.Cursor()
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		if string(value) == deliveryId {
+			return true, cursor.Delete()
+		}
+	}
+
+	return false, nil
+}
+
+func (b *BoltStore) Enqueue(deliveryId string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if _, err := dequeue(tx, deliveryId); err != nil {
+			return err
+		}
+
+		queue := tx.Bucket(queueBucket)
+		seq, err := queue.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		if err := queue.Put(key, []byte(deliveryId)); err != nil {
+			return err
+		}
+
+		return rearm(tx, deliveryId, queuedDeadline)
+	})
+}
+
+func (b *BoltStore) Queued() ([]Delivery, error) {
+	var deliveries []Delivery
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(queueBucket).Cursor()
+		for key, value := cursor.First(); key != nil; {
+			delivery, err := getDelivery(tx, string(value))
+			if err != nil {
+				return err
+			}
+
+			// It was acknowledged in the meantime
+			if delivery == nil {
+				if err := cursor.Delete(); err != nil {
+					return err
+				}
+
+				key, value = cursor.Seek(key)
+				continue
+			}
+
+			deliveries = append(deliveries, Delivery{
+				Timeout:    delivery.Timeout,
+				DeliveryId: string(value),
+				Attempt:    delivery.Attempt,
+			})
+
+			key, value = cursor.Next()
+		}
+
+		return nil
+	})
+
+	return deliveries, err
+}
+
+func (b *BoltStore) Dequeue(deliveryId string, deadline int64) (bool, error) {
+	removed := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		removed, err = dequeue(tx, deliveryId)
+		if err != nil || !removed {
+			return err
+		}
+
+		return rearm(tx, deliveryId, deadline)
+	})
+
+	return removed, err
+}
+
+func (b *BoltStore) QueueLength() (int, error) {
+	length := 0
+	err := b.db.View(func(tx *bolt.Tx) error {
+		length = tx.Bucket(queueBucket).Stats().KeyN
+		return nil
+	})
+
+	return length, err
+}
+
+// Rehydrate only has to find the timeouts that expired while we were down, since the
+// schedule is stored along with them.
+func (b *BoltStore) Rehydrate(now int64) (int, []string, error) {
+	count, err := b.Count()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var late []string
+	err = b.db.View(func(tx *bolt.Tx) error {
+		late = dueKeys(tx.Bucket(scheduleBucket), now, count)
+		return nil
+	})
+
+	return count, late, err
+}
+
+func (b *BoltStore) Ping() error {
+	return nil
+}
+
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,638 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrStoreUnavailable is returned by reads while the store is degraded.
+	ErrStoreUnavailable = errors.New("storage is unavailable")
+
+	// ErrWriteBuffered is returned by writes that were buffered while the store is
+	// degraded, since their result (like the id of a stored timeout, or if there was
+	// anything to cancel) is only known once they're replayed.
+	ErrWriteBuffered = errors.New("storage is unavailable, the write was buffered")
+)
+
+const (
+	walStore     = "store"
+	walCancel    = "cancel"
+	walCancelFor = "cancel_for"
+	walAck       = "ack"
+	walEnqueue   = "enqueue"
+)
+
+// walEntry is a single write buffered in the write-ahead log. Cancellations for a user
+// store the guild, user and type, since the ids are only looked up when replaying.
+type walEntry struct {
+	Op      string   `json:"op"`
+	Timeout *Timeout `json:"timeout,omitempty"`
+	Id      string   `json:"id,omitempty"`
+	GuildId string   `json:"guild_id,omitempty"`
+	UserId  string   `json:"user_id,omitempty"`
+	Type    string   `json:"type,omitempty"`
+}
+
+// BufferedStore wraps a store that can become unreachable, like Redis. Once it does, the
+// store is degraded: writes are appended to a local write-ahead log instead, so they
+// survive a restart, and reads fail with `ErrStoreUnavailable` instead of pretending
+// nothing is stored. The store is pinged every `STORE_HEALTH_INTERVAL`, and once it is
+// reachable again the buffered writes are replayed in order.
+type BufferedStore struct {
+	backend  TimeoutStore
+	interval time.Duration
+	stop     chan struct{}
+
+	// mutex guards the degraded state and the log, but isn't held while waiting on the
+	// backend, so a hanging store doesn't block everything else. replaying makes sure
+	// only one replay runs at a time.
+	mutex         *sync.Mutex
+	replaying     *sync.Mutex
+	wal           *os.File
+	buffered      int
+	degradedSince time.Time
+	lastError     error
+}
+
+func newBufferedStore(backend TimeoutStore, path string) (*BufferedStore, error) {
+	wal, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &BufferedStore{
+		backend:   backend,
+		interval:  envPositiveDuration("STORE_HEALTH_INTERVAL", 5*time.Second),
+		stop:      make(chan struct{}),
+		mutex:     &sync.Mutex{},
+		replaying: &sync.Mutex{},
+		wal:       wal,
+	}
+
+	entries, err := b.entries()
+	if err != nil {
+		_ = wal.Close()
+		return nil, err
+	}
+
+	// We went down while degraded, the writes are replayed before anything else
+	if len(entries) > 0 {
+		logrus.Warnf("Found %d buffered writes in %s from a previous run", len(entries), path)
+		b.buffered = len(entries)
+		b.degradedSince = time.Now()
+		b.lastError = errors.New("buffered writes from a previous run weren't replayed yet")
+	}
+
+	go b.watch()
+	return b, nil
+}
+
+// unavailable returns if the error means the store can't be reached, as opposed to the
+// operation itself failing.
+func unavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var response ErrorResponse
+	if errors.As(err, &response) {
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, redis.ErrClosed) ||
+		strings.Contains(err.Error(), "connection pool timeout")
+}
+
+// Degraded returns if writes are currently being buffered.
+func (b *BufferedStore) Degraded() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return !b.degradedSince.IsZero()
+}
+
+// Status fills in the degraded state of the store.
+func (b *BufferedStore) Status(stats *StorageStats) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stats.Buffered = b.buffered
+	if !b.degradedSince.IsZero() {
+		stats.Degraded = true
+		stats.DegradedSince = b.degradedSince.UnixMilli()
+		stats.Error = b.lastError.Error()
+	}
+}
+
+// degrade marks the store as unavailable, the mutex has to be held.
+func (b *BufferedStore) degrade(err error) {
+	b.lastError = err
+	if !b.degradedSince.IsZero() {
+		return
+	}
+
+	b.degradedSince = time.Now()
+	logrus.Errorf("Storage is unavailable, buffering writes until it is back: %v", err)
+	b.updateMetrics()
+}
+
+// reportMetrics sets the storage gauges from the current state, which is needed for
+// writes that were buffered before metrics were set up, like the ones of a previous run.
+func (b *BufferedStore) reportMetrics() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.updateMetrics()
+}
+
+// updateMetrics sets the storage gauges, the mutex has to be held.
+func (b *BufferedStore) updateMetrics() {
+	if !MetricsEnabled {
+		return
+	}
+
+	degraded := 0.0
+	if !b.degradedSince.IsZero() {
+		degraded = 1
+	}
+
+	DegradedMetric.Set(degraded)
+	BufferedWritesMetric.Set(float64(b.buffered))
+}
+
+// check degrades the store if a read failed because it's unavailable.
+func (b *BufferedStore) check(err error) error {
+	if !unavailable(err) {
+		return err
+	}
+
+	b.mutex.Lock()
+	b.degrade(err)
+	b.mutex.Unlock()
+
+	return fmt.Errorf("%w: %v", ErrStoreUnavailable, err)
+}
+
+// write tries the write on the store, and buffers it if the store is unavailable, in
+// which case it returns `ErrWriteBuffered`. Once the store is degraded, every write is
+// buffered until the log was replayed, so they are applied in order. The degraded state
+// is only checked while appending to the log, so a write can't end up in a log that was
+// just replayed.
+func (b *BufferedStore) write(entry walEntry, fn func() error) error {
+	for {
+		buffered, err := b.buffer(entry)
+		if err != nil {
+			return err
+		}
+
+		if buffered {
+			return ErrWriteBuffered
+		}
+
+		err = fn()
+		if !unavailable(err) {
+			return err
+		}
+
+		b.mutex.Lock()
+		b.degrade(err)
+		b.mutex.Unlock()
+	}
+}
+
+// buffer appends the write to the log if the store is degraded, and reports if it did.
+func (b *BufferedStore) buffer(entry walEntry) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.degradedSince.IsZero() {
+		return false, nil
+	}
+
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := b.wal.Write(append(data, '\n')); err != nil {
+		return false, fmt.Errorf("unable to buffer write: %v", err)
+	}
+
+	if err := b.wal.Sync(); err != nil {
+		return false, fmt.Errorf("unable to buffer write: %v", err)
+	}
+
+	b.buffered++
+	b.updateMetrics()
+
+	return true, nil
+}
+
+// entries reads every write in the log.
+func (b *BufferedStore) entries() ([]walEntry, error) {
+	if _, err := b.wal.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var entries []walEntry
+	scanner := bufio.NewScanner(b.wal)
+	scanner.Buffer(make([]byte, 64*1024), maxDecompressedSize)
+	for scanner.Scan() {
+		var entry walEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// Most likely a write that was cut off by a crash
+			logrus.Warnf("Unable to decode buffered write, skipping: %v", err)
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+func (b *BufferedStore) apply(entry walEntry) error {
+	switch entry.Op {
+	case walStore:
+		{
+			if entry.Timeout == nil {
+				return nil
+			}
+
+			_, _, err := b.backend.Store(*entry.Timeout)
+			return err
+		}
+
+	case walCancel:
+		{
+			_, err := b.backend.Cancel(entry.Id)
+			return err
+		}
+
+	case walCancelFor:
+		{
+			timeouts, err := b.backend.Find(QueryRequest{GuildId: entry.GuildId, UserId: entry.UserId, Type: entry.Type})
+			if err != nil {
+				return err
+			}
+
+			for _, t := range timeouts {
+				if _, err := b.backend.Cancel(t.Id); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+
+	case walAck:
+		{
+			_, err := b.backend.Ack(entry.Id)
+			return err
+		}
+
+	case walEnqueue:
+		return b.backend.Enqueue(entry.Id)
+
+	default:
+		logrus.Warnf("Unknown buffered write %q, skipping", entry.Op)
+		return nil
+	}
+}
+
+// replay replays the buffered writes if the store is reachable again. Every write can
+// safely be applied twice, so the log is only cleared once all of them went through.
+// Writes keep being buffered while replaying, and are replayed as well, until the log
+// is caught up.
+func (b *BufferedStore) replay() {
+	b.replaying.Lock()
+	defer b.replaying.Unlock()
+
+	if !b.Degraded() {
+		return
+	}
+
+	if err := b.backend.Ping(); err != nil {
+		b.mutex.Lock()
+		b.lastError = err
+		b.mutex.Unlock()
+
+		return
+	}
+
+	replayed := 0
+	for {
+		b.mutex.Lock()
+		entries, err := b.entries()
+		if err != nil {
+			b.mutex.Unlock()
+			logrus.Errorf("Unable to read buffered writes: %v", err)
+
+			return
+		}
+
+		if len(entries) <= replayed {
+			b.markAvailable(replayed)
+			b.mutex.Unlock()
+
+			return
+		}
+
+		b.mutex.Unlock()
+		for _, entry := range entries[replayed:] {
+			if err := b.apply(entry); err != nil {
+				if unavailable(err) {
+					b.mutex.Lock()
+					b.lastError = err
+					b.mutex.Unlock()
+
+					return
+				}
+
+				logrus.Errorf("Unable to replay buffered %s, dropping it: %v", entry.Op, err)
+			}
+		}
+
+		replayed = len(entries)
+	}
+}
+
+// markAvailable clears the replayed log and marks the store as available, the mutex has to
+// be held.
+func (b *BufferedStore) markAvailable(replayed int) {
+	if err := b.wal.Truncate(0); err != nil {
+		logrus.Errorf("Unable to clear buffered writes, they'll be replayed again: %v", err)
+		return
+	}
+
+	logrus.Infof("Storage is available again after %s, replayed %d buffered writes", time.Since(b.degradedSince).Round(time.Second), replayed)
+	b.degradedSince = time.Time{}
+	b.lastError = nil
+	b.buffered = 0
+	b.updateMetrics()
+}
+
+// watch pings the store in the background, to notice when it goes away before anything
+// is written, and to replay the buffered writes once it's back.
+func (b *BufferedStore) watch() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+
+		case <-ticker.C:
+			if b.Degraded() {
+				b.replay()
+			} else if err := b.backend.Ping(); unavailable(err) {
+				b.mutex.Lock()
+				b.degrade(err)
+				b.mutex.Unlock()
+			}
+		}
+	}
+}
+
+// Store fails with `ErrWriteBuffered` while degraded, since the timeout may replace
+// another one when it's replayed, and keep that one's id instead.
+func (b *BufferedStore) Store(t Timeout) (Timeout, bool, error) {
+	var stored Timeout
+	var replaced bool
+	err := b.write(walEntry{Op: walStore, Timeout: &t}, func() error {
+		var err error
+		stored, replaced, err = b.backend.Store(t)
+		return err
+	})
+
+	return stored, replaced, err
+}
+
+// Cancel fails with `ErrWriteBuffered` while degraded, since it's unknown if there is
+// anything to cancel.
+func (b *BufferedStore) Cancel(id string) (bool, error) {
+	var cancelled bool
+	err := b.write(walEntry{Op: walCancel, Id: id}, func() error {
+		var err error
+		cancelled, err = b.backend.Cancel(id)
+		return err
+	})
+
+	return cancelled, err
+}
+
+// CancelFor buffers the cancellation of the user's pending timeouts in the guild if the
+// store is degraded, and reports if it did. Their ids can't be looked up while degraded,
+// so they're found when it's replayed, which also cancels timeouts buffered before it.
+// Otherwise the timeouts have to be found and cancelled one by one.
+func (b *BufferedStore) CancelFor(guildId string, userId string, kind string) (bool, error) {
+	return b.buffer(walEntry{Op: walCancelFor, GuildId: guildId, UserId: userId, Type: kind})
+}
+
+// Ack reports a buffered acknowledgement as acknowledged, since nobody waits on it.
+func (b *BufferedStore) Ack(deliveryId string) (bool, error) {
+	acked := true
+	err := b.write(walEntry{Op: walAck, Id: deliveryId}, func() error {
+		var err error
+		acked, err = b.backend.Ack(deliveryId)
+		return err
+	})
+
+	if errors.Is(err, ErrWriteBuffered) {
+		return true, nil
+	}
+
+	return acked, err
+}
+
+func (b *BufferedStore) Enqueue(deliveryId string) error {
+	err := b.write(walEntry{Op: walEnqueue, Id: deliveryId}, func() error {
+		return b.backend.Enqueue(deliveryId)
+	})
+
+	if errors.Is(err, ErrWriteBuffered) {
+		return nil
+	}
+
+	return err
+}
+
+func (b *BufferedStore) Get(id string) (*Timeout, error) {
+	if b.Degraded() {
+		return nil, ErrStoreUnavailable
+	}
+
+	t, err := b.backend.Get(id)
+	return t, b.check(err)
+}
+
+func (b *BufferedStore) Find(q QueryRequest) ([]Timeout, error) {
+	if b.Degraded() {
+		return nil, ErrStoreUnavailable
+	}
+
+	timeouts, err := b.backend.Find(q)
+	return timeouts, b.check(err)
+}
+
+func (b *BufferedStore) Page(q QueryRequest) (QueryResponse, error) {
+	if b.Degraded() {
+		return QueryResponse{}, ErrStoreUnavailable
+	}
+
+	page, err := b.backend.Page(q)
+	return page, b.check(err)
+}
+
+func (b *BufferedStore) Scan(size int, fn func(timeouts []Timeout) error) error {
+	if b.Degraded() {
+		return ErrStoreUnavailable
+	}
+
+	return b.check(b.backend.Scan(size, fn))
+}
+
+func (b *BufferedStore) Count() (int, error) {
+	if b.Degraded() {
+		return 0, ErrStoreUnavailable
+	}
+
+	count, err := b.backend.Count()
+	return count, b.check(err)
+}
+
+// Update isn't buffered, since the change depends on the stored timeout, so it fails with
+// `ErrStoreUnavailable` like reads while degraded.
+func (b *BufferedStore) Update(id string, change func(t Timeout) (Timeout, error)) (*Timeout, *Timeout, error) {
+	if b.Degraded() {
+		return nil, nil, ErrStoreUnavailable
+	}
+
+	before, after, err := b.backend.Update(id, change)
+	return before, after, b.check(err)
+}
+
+func (b *BufferedStore) Due(now int64, limit int) ([]string, error) {
+	if b.Degraded() {
+		return nil, ErrStoreUnavailable
+	}
+
+	ids, err := b.backend.Due(now, limit)
+	return ids, b.check(err)
+}
+
+func (b *BufferedStore) Claim(id string, now int64, deliveryId string, deadline int64) (*Timeout, error) {
+	if b.Degraded() {
+		return nil, ErrStoreUnavailable
+	}
+
+	t, err := b.backend.Claim(id, now, deliveryId, deadline)
+	return t, b.check(err)
+}
+
+func (b *BufferedStore) Unacknowledged(now int64, limit int) ([]Delivery, error) {
+	if b.Degraded() {
+		return nil, ErrStoreUnavailable
+	}
+
+	deliveries, err := b.backend.Unacknowledged(now, limit)
+	return deliveries, b.check(err)
+}
+
+func (b *BufferedStore) Redeliver(deliveryId string, now int64, backoff time.Duration, maxBackoff time.Duration) (*Delivery, error) {
+	if b.Degraded() {
+		return nil, ErrStoreUnavailable
+	}
+
+	delivery, err := b.backend.Redeliver(deliveryId, now, backoff, maxBackoff)
+	return delivery, b.check(err)
+}
+
+func (b *BufferedStore) Queued() ([]Delivery, error) {
+	if b.Degraded() {
+		return nil, ErrStoreUnavailable
+	}
+
+	deliveries, err := b.backend.Queued()
+	return deliveries, b.check(err)
+}
+
+func (b *BufferedStore) Dequeue(deliveryId string, deadline int64) (bool, error) {
+	if b.Degraded() {
+		return false, ErrStoreUnavailable
+	}
+
+	removed, err := b.backend.Dequeue(deliveryId, deadline)
+	return removed, b.check(err)
+}
+
+func (b *BufferedStore) QueueLength() (int, error) {
+	if b.Degraded() {
+		return 0, ErrStoreUnavailable
+	}
+
+	length, err := b.backend.QueueLength()
+	return length, b.check(err)
+}
+
+// Rehydrate replays the writes buffered by a previous run first, so they're rehydrated too.
+func (b *BufferedStore) Rehydrate(now int64) (int, []string, error) {
+	b.replay()
+	if b.Degraded() {
+		return 0, nil, ErrStoreUnavailable
+	}
+
+	return b.backend.Rehydrate(now)
+}
+
+func (b *BufferedStore) Ping() error {
+	return b.backend.Ping()
+}
+
+func (b *BufferedStore) Close() error {
+	close(b.stop)
+	if err := b.wal.Close(); err != nil {
+		logrus.Errorf("Unable to close the write-ahead log: %v", err)
+	}
+
+	return b.backend.Close()
+}
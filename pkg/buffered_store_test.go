@@ -0,0 +1,353 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"errors"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+// newTestBufferedStore buffers the writes to the backend in a log at `path`. The health
+// check never runs on its own, the tests replay explicitly.
+func newTestBufferedStore(t *testing.T, backend TimeoutStore, path string) *BufferedStore {
+	t.Setenv("STORE_HEALTH_INTERVAL", "1h")
+	b, err := newBufferedStore(backend, path)
+	if err != nil {
+		t.Fatalf("newBufferedStore() error = %v", err)
+	}
+
+	t.Cleanup(func() {
+		_ = b.Close()
+	})
+
+	return b
+}
+
+func TestBufferedStoreDegraded(t *testing.T) {
+	backend, mr := newTestRedisStore(t)
+	b := newTestBufferedStore(t, backend, filepath.Join(t.TempDir(), "wal"))
+	if _, _, err := b.Store(testTimeout("a", "1", "2", "mute", 100)); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+
+	mr.Close()
+	if _, _, err := b.Store(testTimeout("b", "1", "2", "ban", 100)); !errors.Is(err, ErrWriteBuffered) {
+		t.Errorf("Store() error = %v, want ErrWriteBuffered", err)
+	}
+
+	if !b.Degraded() {
+		t.Fatalf("Degraded() = false after the store went away")
+	}
+
+	if _, err := b.Cancel("a"); !errors.Is(err, ErrWriteBuffered) {
+		t.Errorf("Cancel() error = %v, want ErrWriteBuffered", err)
+	}
+
+	if acked, err := b.Ack("delivery"); !acked || err != nil {
+		t.Errorf("Ack() = %v, %v, want true, nil", acked, err)
+	}
+
+	if _, err := b.Get("a"); !errors.Is(err, ErrStoreUnavailable) {
+		t.Errorf("Get() error = %v, want ErrStoreUnavailable", err)
+	}
+
+	if _, _, err := b.Update("a", func(t Timeout) (Timeout, error) { return t, nil }); !errors.Is(err, ErrStoreUnavailable) {
+		t.Errorf("Update() error = %v, want ErrStoreUnavailable", err)
+	}
+
+	var stats StorageStats
+	b.Status(&stats)
+	if !stats.Degraded || stats.Buffered != 3 || stats.Error == "" {
+		t.Errorf("Status() = %+v, want degraded with 3 buffered writes", stats)
+	}
+
+	// Still unreachable, so nothing is replayed yet
+	b.replay()
+	if !b.Degraded() {
+		t.Errorf("Degraded() = false while the store is still unavailable")
+	}
+}
+
+func TestBufferedStoreReplaysInOrder(t *testing.T) {
+	backend, mr := newTestRedisStore(t)
+	b := newTestBufferedStore(t, backend, filepath.Join(t.TempDir(), "wal"))
+	if _, _, err := b.Store(testTimeout("a", "1", "2", "mute", 100)); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+
+	mr.Close()
+	writes := []func() error{
+		func() error { _, err := b.Cancel("a"); return err },
+		func() error { _, _, err := b.Store(testTimeout("b", "1", "2", "mute", 200)); return err },
+		func() error { _, _, err := b.Store(testTimeout("c", "1", "2", "mute", 300)); return err },
+		func() error { _, _, err := b.Store(testTimeout("d", "1", "2", "ban", 400)); return err },
+		func() error { _, err := b.Cancel("d"); return err },
+	}
+
+	for i, write := range writes {
+		if err := write(); !errors.Is(err, ErrWriteBuffered) {
+			t.Fatalf("write %d error = %v, want ErrWriteBuffered", i, err)
+		}
+	}
+
+	if err := mr.Restart(); err != nil {
+		t.Fatalf("Unable to restart Redis: %v", err)
+	}
+
+	b.replay()
+	if b.Degraded() {
+		t.Fatalf("Degraded() = true after the store came back")
+	}
+
+	var stats StorageStats
+	b.Status(&stats)
+	if stats.Buffered != 0 {
+		t.Errorf("Status().Buffered = %d, want 0", stats.Buffered)
+	}
+
+	// "c" replaced "b" and kept its id, and "a" and "d" were cancelled
+	timeouts, err := b.Find(QueryRequest{GuildId: "1", UserId: "2"})
+	if err != nil {
+		t.Fatalf("Find() error = %v", err)
+	}
+
+	if len(timeouts) != 1 || timeouts[0].Id != "b" || timeouts[0].ExpiresAt != 300 {
+		t.Errorf("Find() = %+v, want only b expiring at 300", timeouts)
+	}
+
+	// The log was cleared, so a restart doesn't replay it again
+	if entries, err := b.entries(); err != nil || len(entries) != 0 {
+		t.Errorf("entries() = %v, %v, want none", entries, err)
+	}
+}
+
+func TestBufferedStoreReplaysCancelFor(t *testing.T) {
+	backend, mr := newTestRedisStore(t)
+	b := newTestBufferedStore(t, backend, filepath.Join(t.TempDir(), "wal"))
+	for _, timeout := range []Timeout{
+		testTimeout("a", "1", "2", "mute", 100),
+		testTimeout("b", "1", "3", "mute", 100),
+	} {
+		if _, _, err := b.Store(timeout); err != nil {
+			t.Fatalf("Store() error = %v", err)
+		}
+	}
+
+	if buffered, err := b.CancelFor("1", "2", ""); buffered || err != nil {
+		t.Errorf("CancelFor() = %v, %v, want nothing buffered while the store is available", buffered, err)
+	}
+
+	mr.Close()
+	if _, _, err := b.Store(testTimeout("c", "1", "2", "ban", 200)); !errors.Is(err, ErrWriteBuffered) {
+		t.Fatalf("Store() error = %v, want ErrWriteBuffered", err)
+	}
+
+	// The ids are looked up when replaying, so the buffered ban is cancelled as well
+	if buffered, err := b.CancelFor("1", "2", ""); !buffered || err != nil {
+		t.Fatalf("CancelFor() = %v, %v, want it buffered", buffered, err)
+	}
+
+	if _, _, err := b.Store(testTimeout("d", "1", "2", "mute", 300)); !errors.Is(err, ErrWriteBuffered) {
+		t.Fatalf("Store() error = %v, want ErrWriteBuffered", err)
+	}
+
+	if err := mr.Restart(); err != nil {
+		t.Fatalf("Unable to restart Redis: %v", err)
+	}
+
+	b.replay()
+	if b.Degraded() {
+		t.Fatalf("Degraded() = true after the store came back")
+	}
+
+	for _, test := range []struct {
+		user string
+		want string
+	}{{"2", "d"}, {"3", "b"}} {
+		timeouts, err := b.Find(QueryRequest{GuildId: "1", UserId: test.user})
+		if err != nil {
+			t.Fatalf("Find() error = %v", err)
+		}
+
+		if len(timeouts) != 1 || timeouts[0].Id != test.want {
+			t.Errorf("Find() for user %s = %+v, want only %s", test.user, timeouts, test.want)
+		}
+	}
+}
+
+func TestBufferedStoreReplaysPreviousRun(t *testing.T) {
+	t.Setenv("STORE_HEALTH_INTERVAL", "1h")
+	path := filepath.Join(t.TempDir(), "wal")
+	backend, mr := newTestRedisStore(t)
+	b, err := newBufferedStore(backend, path)
+	if err != nil {
+		t.Fatalf("newBufferedStore() error = %v", err)
+	}
+
+	mr.Close()
+	if _, _, err := b.Store(testTimeout("a", "1", "2", "mute", 100)); !errors.Is(err, ErrWriteBuffered) {
+		t.Fatalf("Store() error = %v, want ErrWriteBuffered", err)
+	}
+
+	// Went down while degraded, the log is picked up by the next run
+	_ = b.Close()
+	if err := mr.Restart(); err != nil {
+		t.Fatalf("Unable to restart Redis: %v", err)
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	restarted := newTestBufferedStore(t, &RedisStore{client: client, keys: backend.keys}, path)
+	if !restarted.Degraded() {
+		t.Fatalf("Degraded() = false with writes left from a previous run")
+	}
+
+	// Metrics are set up after the store, and have to pick up its state
+	MetricsEnabled = true
+	t.Cleanup(func() {
+		MetricsEnabled = false
+		DegradedMetric.Set(0)
+		BufferedWritesMetric.Set(0)
+	})
+
+	restarted.reportMetrics()
+	if degraded, buffered := testutil.ToFloat64(DegradedMetric), testutil.ToFloat64(BufferedWritesMetric); degraded != 1 || buffered != 1 {
+		t.Errorf("metrics = %v degraded and %v buffered writes, want 1 and 1", degraded, buffered)
+	}
+
+	total, late, err := restarted.Rehydrate(200)
+	if err != nil {
+		t.Fatalf("Rehydrate() error = %v", err)
+	}
+
+	if total != 1 || len(late) != 1 || late[0] != "a" {
+		t.Errorf("Rehydrate() = %d, %v, want the replayed timeout to be late", total, late)
+	}
+
+	if restarted.Degraded() {
+		t.Errorf("Degraded() = true after replaying the previous run")
+	}
+
+	if degraded, buffered := testutil.ToFloat64(DegradedMetric), testutil.ToFloat64(BufferedWritesMetric); degraded != 0 || buffered != 0 {
+		t.Errorf("metrics after replaying = %v degraded and %v buffered writes, want 0 and 0", degraded, buffered)
+	}
+}
+
+// flakyStore is a memory store that can be taken down, without the latency of a network
+// connection to widen the window between writes and replays.
+type flakyStore struct {
+	*MemoryStore
+	down int32
+}
+
+func (f *flakyStore) available() error {
+	if atomic.LoadInt32(&f.down) == 1 {
+		return syscall.ECONNREFUSED
+	}
+
+	return nil
+}
+
+func (f *flakyStore) Store(t Timeout) (Timeout, bool, error) {
+	if err := f.available(); err != nil {
+		return Timeout{}, false, err
+	}
+
+	return f.MemoryStore.Store(t)
+}
+
+func (f *flakyStore) Ping() error {
+	return f.available()
+}
+
+func TestBufferedStoreWritesDuringReplay(t *testing.T) {
+	backend := &flakyStore{MemoryStore: newMemoryStore()}
+	b := newTestBufferedStore(t, backend, filepath.Join(t.TempDir(), "wal"))
+
+	for round := 0; round < 10; round++ {
+		guild := strconv.Itoa(round)
+		atomic.StoreInt32(&backend.down, 1)
+		if _, _, err := b.Store(testTimeout(guild+"-0", guild, "0", "mute", 100)); !errors.Is(err, ErrWriteBuffered) {
+			t.Fatalf("Store() error = %v, want ErrWriteBuffered", err)
+		}
+
+		// Writes that are still on their way to the log while it's being replayed
+		atomic.StoreInt32(&backend.down, 0)
+		var wg sync.WaitGroup
+		for i := 1; i <= 20; i++ {
+			wg.Add(1)
+			go func(user string) {
+				defer wg.Done()
+				if _, _, err := b.Store(testTimeout(guild+"-"+user, guild, user, "mute", 100)); err != nil && !errors.Is(err, ErrWriteBuffered) {
+					t.Errorf("Store() error = %v", err)
+				}
+			}(strconv.Itoa(i))
+		}
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+
+		for replaying := true; replaying; {
+			select {
+			case <-done:
+				replaying = false
+			default:
+				b.replay()
+			}
+		}
+
+		b.replay()
+		if b.Degraded() {
+			t.Fatalf("Degraded() = true after the store came back")
+		}
+
+		// Nothing may be left in the log once the store is healthy, it wouldn't be
+		// replayed until the next outage
+		var stats StorageStats
+		b.Status(&stats)
+		if stats.Buffered != 0 {
+			t.Fatalf("round %d: Status().Buffered = %d, want 0", round, stats.Buffered)
+		}
+
+		if entries, err := b.entries(); err != nil || len(entries) != 0 {
+			t.Fatalf("round %d: entries() = %v, %v, want none", round, entries, err)
+		}
+	}
+
+	// A write that checks the degraded state right after the log was replayed goes
+	// straight to the store
+	if buffered, err := b.buffer(walEntry{Op: walCancel, Id: "0-0"}); buffered || err != nil {
+		t.Errorf("buffer() = %v, %v, want nothing buffered while the store is available", buffered, err)
+	}
+
+	if count, err := b.Count(); err != nil || count != 10*21 {
+		t.Errorf("Count() = %d, %v, want %d", count, err, 10*21)
+	}
+}
@@ -21,42 +21,76 @@
 package pkg
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
-type Client struct {
-	Conn      *websocket.Conn
-	writeLock *sync.Mutex
+// operationScopes are the token scopes needed to send each operation.
+var operationScopes = map[OperationType]string{
+	RequestAll: ScopeRead,
+	Query:      ScopeRead,
+	Stats:      ScopeRead,
+	Request:    ScopeWrite,
+	Cancel:     ScopeWrite,
+	Update:     ScopeWrite,
+	Ack:        ScopeWrite,
 }
 
-func marshalToString(d interface{}) string {
-	bytes, _ := json.Marshal(d)
-	return string(bytes)
+type Client struct {
+	Conn         *websocket.Conn
+	ShardId      int
+	ShardCount   int
+	Name         string
+	Version      string
+	Capabilities []string
+	RemoteAddr   string
+	ConnectedAt  time.Time
+	Token        *Token
+
+	// connectedAs is the token of the `Authorization` header or client certificate the
+	// client connected with, if any
+	connectedAs *Token
+	encoding    *Encoding
+	limiter     *rate.Limiter
+	writeLock   *sync.Mutex
+	done        chan struct{}
+
+	// deliveries are sent by the client's own goroutine, so a slow connection doesn't
+	// hold up the scheduler or the other shards
+	deliveries chan Delivery
+
+	stateLock  *sync.Mutex
+	identified bool
+	session    *Session
 }
 
-func toTimeout(item map[string]interface{}) Timeout {
-	t := Timeout{
-		Type:        item["type"].(string),
-		GuildId:     item["guild_id"].(string),
-		UserId:      item["user_id"].(string),
-		IssuedAt:    int64(item["issued_at"].(float64)),
-		ExpiresAt:   int64(item["expires_at"].(float64)),
-		ModeratorId: item["moderator"].(string),
+// ShardFor returns which shard a guild belongs to, using Discord's sharding formula.
+func ShardFor(guildId string, shardCount int) int {
+	id, err := strconv.ParseUint(guildId, 10, 64)
+	if err != nil || shardCount < 1 {
+		return 0
 	}
 
-	if item["reason"] != nil {
-		t.Reason = item["reason"].(string)
-	}
+	return int((id >> 22) % uint64(shardCount))
+}
 
-	return t
+// Owns returns if the guild belongs to this client's shard.
+func (c *Client) Owns(guildId string) bool {
+	return ShardFor(guildId, c.ShardCount) == c.ShardId
+}
+
+func marshalToString(d interface{}) string {
+	bytes, _ := json.Marshal(d)
+	return string(bytes)
 }
 
 func mapAll(toMap interface{}) []Timeout {
@@ -66,118 +100,412 @@ func mapAll(toMap interface{}) []Timeout {
 	return timeouts
 }
 
-func (c *Client) WriteMessage(msg Message) {
+// WriteMessage writes the message to the client, and returns an error if it couldn't
+// be written.
+func (c *Client) WriteMessage(msg Message) error {
+	frameType, data, err := c.encoding.Encode(msg)
+	if err != nil {
+		logrus.Errorf("Unable to encode %s as %s: %v", marshalToString(msg), c.encoding.Name, err)
+		return err
+	}
+
 	c.writeLock.Lock()
-	err := c.Conn.WriteJSON(msg)
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(Server.heartbeatTimeout))
+	err = c.Conn.WriteMessage(frameType, data)
 	c.writeLock.Unlock()
 
 	if err != nil {
+		// The connection is most likely dead, closing it makes the read loop notice
 		logrus.Errorf("Unable to write %s to client: %v", marshalToString(msg), err)
-	} else {
-		logrus.Debugf("Wrote data to client: %s", marshalToString(msg))
+		_ = c.Conn.Close()
+
+		return err
 	}
+
+	logrus.Debugf("Wrote data to client: %s", marshalToString(msg))
+	return nil
 }
 
-func (c *Client) HandleTimeout(t Timeout) {
-	logrus.Debugf("Told to handle timeout (type=%s; guild=%s; user=%s)", t.Type, t.GuildId, t.UserId)
-	key := fmt.Sprintf("%s:%s", t.GuildId, t.UserId)
-	bytes, err := json.Marshal(&t)
-	if err != nil {
-		logrus.Errorf("Unable to marshal timeout %v: %v", t, err)
+func (c *Client) Session() *Session {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	return c.session
+}
+
+func (c *Client) setSession(session *Session) {
+	c.stateLock.Lock()
+	c.session = session
+	c.stateLock.Unlock()
+}
+
+// Identified returns if the client finished the handshake with an `Identify` or `Resume`.
+func (c *Client) Identified() bool {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	return c.identified
+}
+
+func (c *Client) setIdentified() {
+	c.stateLock.Lock()
+	c.identified = true
+	c.stateLock.Unlock()
+}
+
+func (c *Client) HasCapability(capability string) bool {
+	for _, other := range c.Capabilities {
+		if other == capability {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Client) Stats() ClientStats {
+	stats := ClientStats{
+		Name:         c.Name,
+		Version:      c.Version,
+		ShardId:      c.ShardId,
+		ShardCount:   c.ShardCount,
+		Capabilities: c.Capabilities,
+		Encoding:     c.encoding.Name,
+		Compress:     c.encoding.Compress,
+		RemoteAddr:   c.RemoteAddr,
+		ConnectedAt:  c.ConnectedAt.UnixMilli(),
+	}
+
+	if c.Token != nil {
+		stats.Token = c.Token.Name
+	}
+
+	return stats
+}
+
+// SendEvent sends an event with the next sequence number of the client's session, and
+// returns an error if it wasn't written to the client.
+func (c *Client) SendEvent(op OperationType, data interface{}) error {
+	return c.Session().Send(Message{
+		OP:   op,
+		Data: data,
+	})
+}
+
+// Deliver queues an `Apply` event for the delivery, without waiting for it to be written.
+// If the queue is full, or the client disconnects before it's sent, the delivery stays
+// unacknowledged and is redelivered.
+func (c *Client) Deliver(d Delivery) {
+	select {
+	case c.deliveries <- d:
+	default:
+		logrus.Warnf("Too many events are queued for shard #%d, delivery %s will be redelivered", c.ShardId, d.DeliveryId)
 	}
+}
+
+// deliver sends the queued deliveries until the client disconnects.
+func (c *Client) deliver() {
+	for {
+		select {
+		case <-c.done:
+			return
+
+		case d := <-c.deliveries:
+			c.apply(d)
+		}
+	}
+}
 
-	if err = Redis.Connection.HMSet(context.TODO(), "nino:timeouts", key, string(bytes)).Err(); err != nil {
-		logrus.Errorf("Unable to store timeout %v into Redis: %v", t, err)
+// apply sends an `Apply` event for the delivery. Clients without the `ack` capability
+// can't acknowledge it, so it's acknowledged once it was written. Otherwise it stays
+// unacknowledged and is redelivered.
+func (c *Client) apply(d Delivery) {
+	if err := c.SendEvent(Apply, d); err != nil {
+		logrus.Warnf("Unable to send delivery %s to shard #%d, it will be redelivered: %v", d.DeliveryId, c.ShardId, err)
+		return
 	}
 
-	go func() {
+	if !c.HasCapability(CapabilityAck) {
+		if _, err := Scheduler.Ack(d.DeliveryId); err != nil {
+			logrus.Errorf("Unable to acknowledge delivery %s: %v", d.DeliveryId, err)
+		}
+	}
+}
+
+// keepAlive extends the read deadline, a client that doesn't send anything (not even
+// a heartbeat or pong) before it passes is considered disconnected.
+func (c *Client) keepAlive() {
+	_ = c.Conn.SetReadDeadline(time.Now().Add(Server.heartbeatTimeout))
+}
+
+// ping sends WebSocket pings every heartbeat interval until the client disconnects,
+// so clients that don't send `Heartbeat`s are kept alive by their pongs. Clients whose
+// token expired or was revoked in the meantime are disconnected.
+func (c *Client) ping() {
+	ticker := time.NewTicker(Server.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
 		select {
-		case <-time.After(time.Duration(t.ExpiresAt-t.IssuedAt) * time.Millisecond):
-			{
-				if MetricsEnabled {
-					TimeoutMetric.Dec()
-				}
+		case <-c.done:
+			return
 
-				if !Server.HasClient() {
-					Server.QueueIn(t)
-					logrus.Warnf("Client has been disconnected, added pending timeout to replay soon.")
+		case <-ticker.C:
+			// The shard is only set once the client is identified, so it's read after that
+			identified := c.Identified()
+			if identified && Tokens.Current(c.Token) == nil {
+				logrus.Warnf("Token %s of shard #%d expired or was revoked, closing connection", c.Token.Name, c.ShardId)
+				_ = c.Conn.Close()
 
-					return
-				}
+				return
+			}
 
-				// pop from redis
-				_, err := Redis.Connection.HGet(context.TODO(), "nino:timeouts", fmt.Sprintf("%s:%s", t.GuildId, t.UserId)).Result()
-				if err != nil {
-					logrus.Warnf("Timeout doesn't exist anymore? %v", err)
+			if err := c.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(Server.heartbeatTimeout)); err != nil {
+				if identified {
+					logrus.Debugf("Unable to ping shard #%d: %v", c.ShardId, err)
+				} else {
+					logrus.Debugf("Unable to ping client from %s: %v", c.RemoteAddr, err)
 				}
+			}
+		}
+	}
+}
 
-				if err = Redis.Connection.HDel(context.TODO(), "nino:timeouts", fmt.Sprintf("%s:%s", t.GuildId, t.UserId)).Err(); err != nil {
-					logrus.Errorf("Unable to delete timeout from cache: %v", err)
-				}
+// Reply sends a response to the given message, echoing its nonce, and returns an error
+// if it couldn't be written.
+func (c *Client) Reply(to Message, op OperationType, data interface{}) error {
+	return c.WriteMessage(Message{
+		OP:    op,
+		Data:  data,
+		Nonce: to.Nonce,
+	})
+}
 
-				c.WriteMessage(Message{
-					OP:   Apply,
-					Data: t,
-				})
-			}
+// WriteError sends an `Error` operation in response to the given message.
+func (c *Client) WriteError(to Message, err error) {
+	c.Reply(to, Error, toErrorResponse(err))
+}
+
+func (c *Client) HandleTimeout(t Timeout) (Timeout, error) {
+	logrus.Debugf("Told to handle timeout (type=%s; guild=%s; user=%s)", t.Type, t.GuildId, t.UserId)
+	stored, err := Scheduler.Schedule(t)
+	if err != nil {
+		// Buffered writes are applied later, there's nothing to report
+		if !errors.Is(err, ErrWriteBuffered) {
+			logrus.Errorf("Unable to store timeout %v: %v", t, err)
 		}
-	}()
+
+		return t, err
+	}
+
+	return stored, nil
 }
 
 func (c *Client) HandleMessage(msg Message, t time.Time) {
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Errorf("Recovered from panic while handling %s: %v", marshalToString(msg), r)
+			c.WriteError(msg, newError(ErrorInternal, "", "Internal error while handling the message"))
+		}
+	}()
+
+	if Tokens.Current(c.Token) == nil {
+		logrus.Warnf("Token %s of the client from %s expired or was revoked, closing connection", c.Token.Name, c.RemoteAddr)
+		c.WriteError(msg, newError(ErrorUnauthorized, "token", "Token expired or revoked"))
+		_ = c.Conn.Close()
+
+		return
+	}
+
+	if scope, ok := operationScopes[msg.OP]; ok && !Tokens.Use(c.Token, scope, fmt.Sprintf("op %d", msg.OP)) {
+		c.WriteError(msg, newError(ErrorForbidden, "op", fmt.Sprintf("Token is missing the `%s` scope", scope)))
+		return
+	}
+
 	switch msg.OP {
 	case RequestAll:
 		{
-			data, err := Redis.Connection.HGetAll(context.TODO(), "nino:timeouts").Result()
+			// Stop scanning once the connection is gone
+			var writeErr error
+			err := Scheduler.Scan(func(chunk TimeoutChunk) error {
+				writeErr = c.Reply(msg, RequestAll, chunk)
+				return writeErr
+			})
+
+			if writeErr != nil {
+				return
+			}
+
 			if err != nil {
 				logrus.Warnf("Unable to retrieve all timeouts, are we connected?\n%v", err)
-				c.WriteMessage(Message{
-					OP:   RequestAll,
-					Data: []Timeout{},
-				})
+				c.WriteError(msg, err)
 
 				return
 			}
+		}
 
-			// serialize output to map[string]Timeout{}
-			mappedData := map[string]Timeout{}
-			for key, value := range data {
-				timeout := Timeout{}
-				if err := json.NewDecoder(strings.NewReader(value)).Decode(&timeout); err != nil {
-					logrus.Warnf("Unable to decode packet %s, skipping", value)
-					continue
-				}
+	case Request:
+		{
+			var req TimeoutRequest
+			if err := decodeData(msg.Data, &req); err != nil {
+				c.WriteError(msg, err)
+				return
+			}
+
+			timeout := req.Timeout
+			if timeout.ModeratorId == "" {
+				timeout.ModeratorId = req.Moderator
+			}
 
-				mappedData[key] = timeout
+			// Ids are always assigned by us
+			timeout.Id = ""
+			if err := validateTimeout(timeout); err != nil {
+				c.WriteError(msg, err)
+				return
 			}
 
-			c.WriteMessage(Message{
-				OP:   RequestAll,
-				Data: mappedData,
+			stored, err := c.HandleTimeout(timeout)
+			if err != nil {
+				c.WriteError(msg, err)
+				return
+			}
+
+			c.Reply(msg, Created, stored)
+		}
+
+	case Cancel:
+		{
+			var req CancelRequest
+			if err := decodeData(msg.Data, &req); err != nil {
+				c.WriteError(msg, err)
+				return
+			}
+
+			if err := validateCancel(req); err != nil {
+				c.WriteError(msg, err)
+				return
+			}
+
+			var cancelled bool
+			var err error
+			if req.Id != "" {
+				cancelled, err = Scheduler.Cancel(req.Id)
+			} else {
+				cancelled, err = Scheduler.CancelFor(req.GuildId, req.UserId, req.Type)
+			}
+
+			if err != nil {
+				logrus.Errorf("Unable to cancel timeout (id=%s; type=%s; guild=%s; user=%s): %v", req.Id, req.Type, req.GuildId, req.UserId, err)
+				c.WriteError(msg, err)
+
+				return
+			}
+
+			c.Reply(msg, Cancel, CancelResponse{
+				CancelRequest: req,
+				Cancelled:     cancelled,
 			})
 		}
 
-	case Request:
+	case Update:
 		{
-			if MetricsEnabled {
-				TimeoutMetric.Inc()
+			var req UpdateRequest
+			if err := decodeData(msg.Data, &req); err != nil {
+				c.WriteError(msg, err)
+				return
 			}
 
-			c.HandleTimeout(toTimeout(msg.Data.(map[string]interface{})))
+			if err := validateUpdate(req); err != nil {
+				c.WriteError(msg, err)
+				return
+			}
+
+			before, after, err := Scheduler.Update(req)
+			if err != nil {
+				logrus.Errorf("Unable to update timeout (type=%s; guild=%s; user=%s): %v", req.Type, req.GuildId, req.UserId, err)
+				c.WriteError(msg, err)
+
+				return
+			}
+
+			c.Reply(msg, Update, UpdateResponse{
+				Before: before,
+				After:  after,
+			})
+		}
+
+	case Ack:
+		{
+			var req AckRequest
+			if err := decodeData(msg.Data, &req); err != nil {
+				c.WriteError(msg, err)
+				return
+			}
+
+			if err := validateAck(req); err != nil {
+				c.WriteError(msg, err)
+				return
+			}
+
+			acked, err := Scheduler.Ack(req.DeliveryId)
+			if err != nil {
+				logrus.Errorf("Unable to acknowledge delivery %s: %v", req.DeliveryId, err)
+				c.WriteError(msg, err)
+			} else if !acked {
+				logrus.Debugf("Delivery %s was already acknowledged", req.DeliveryId)
+			}
+		}
+
+	case Query:
+		{
+			var req QueryRequest
+			if err := decodeData(msg.Data, &req); err != nil {
+				c.WriteError(msg, err)
+				return
+			}
+
+			if err := validateQuery(req); err != nil {
+				c.WriteError(msg, err)
+				return
+			}
+
+			res, err := Scheduler.Query(req)
+			if err != nil {
+				logrus.Warnf("Unable to query timeouts, are we connected?\n%v", err)
+				c.WriteError(msg, err)
+
+				return
+			}
+
+			c.Reply(msg, Query, res)
+		}
+
+	case Heartbeat:
+		{
+			c.Reply(msg, HeartbeatAck, nil)
+		}
+
+	case Identify, Resume:
+		{
+			c.WriteError(msg, newError(ErrorInvalidMessage, "op", "Already identified"))
+			return
 		}
 
 	case Stats:
 		{
-			c.WriteMessage(Message{
-				OP: Stats,
-				Data: map[string]interface{}{
-					"go_version": strings.TrimPrefix(runtime.GOOS, "go"),
-					"version":    Version,
-					"commit_sha": CommitHash,
-					"build_date": BuildDate,
-				},
+			c.Reply(msg, Stats, map[string]interface{}{
+				"go_version": strings.TrimPrefix(runtime.GOOS, "go"),
+				"version":    Version,
+				"commit_sha": CommitHash,
+				"build_date": BuildDate,
+				"clients":    Server.ClientStats(),
+				"storage":    StorageStatus(),
 			})
 		}
+
+	default:
+		c.WriteError(msg, newError(ErrorUnknownOperation, "op", fmt.Sprintf("Unknown operation %d", msg.OP)))
+		return
 	}
 
 	if MetricsEnabled {
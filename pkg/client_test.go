@@ -0,0 +1,62 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package pkg
+
+import "testing"
+
+func TestShardFor(t *testing.T) {
+	tests := []struct {
+		guildId    string
+		shardCount int
+		want       int
+	}{
+		{"41771983423143937", 16, 6},
+		{"41771983423143937", 100, 34},
+		{testGuildId, 2, 0},
+		{testGuildId, 16, 4},
+		{testGuildId, 100, 96},
+		{"300000000004194304", 2, 1},
+		{"300000000004194304", 16, 3},
+		{testGuildId, 1, 0},
+		{"300000000004194304", 1, 0},
+		{testGuildId, 0, 0},
+		{"300000000004194304", 0, 0},
+		{"not a snowflake", 16, 0},
+	}
+
+	for _, test := range tests {
+		if got := ShardFor(test.guildId, test.shardCount); got != test.want {
+			t.Errorf("ShardFor(%q, %d) = %d, want %d", test.guildId, test.shardCount, got, test.want)
+		}
+
+		c := &Client{ShardId: test.want, ShardCount: test.shardCount}
+		if !c.Owns(test.guildId) {
+			t.Errorf("shard #%d of %d doesn't own guild %s", test.want, test.shardCount, test.guildId)
+		}
+
+		// Every other shard doesn't
+		for shard := 0; shard < test.shardCount; shard++ {
+			c := &Client{ShardId: shard, ShardCount: test.shardCount}
+			if shard != test.want && c.Owns(test.guildId) {
+				t.Errorf("shard #%d of %d owns guild %s, want only #%d", shard, test.shardCount, test.guildId, test.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+	"io"
+	"net/http"
+	"reflect"
+)
+
+const (
+	EncodingJSON    = "json"
+	EncodingMsgpack = "msgpack"
+	EncodingCBOR    = "cbor"
+
+	CompressZlib = "zlib"
+
+	// maxDecompressedSize limits how large a message sent by a client can get, both as a
+	// frame and once inflated
+	maxDecompressedSize = 16 << 20
+)
+
+var (
+	cborEncoder, _ = cbor.EncOptions{}.EncMode()
+	cborDecoder, _ = cbor.DecOptions{
+		// So decoded payloads can be validated like JSON ones
+		DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+	}.DecMode()
+)
+
+// Encoding is how the frames of a connection are encoded, negotiated with the `encoding`
+// and `compress` query parameters when connecting. Every encoding uses the `json` struct
+// tags, so messages have the same shape in all of them.
+type Encoding struct {
+	Name     string
+	Compress bool
+
+	binary    bool
+	marshal   func(interface{}) ([]byte, error)
+	unmarshal func([]byte, interface{}) error
+}
+
+// encodingFor returns the encoding the request asks for, defaulting to uncompressed JSON.
+func encodingFor(req *http.Request) (*Encoding, error) {
+	query := req.URL.Query()
+
+	var encoding *Encoding
+	switch name := query.Get("encoding"); name {
+	case "", EncodingJSON:
+		encoding = &Encoding{Name: EncodingJSON, marshal: json.Marshal, unmarshal: json.Unmarshal}
+
+	case EncodingMsgpack:
+		encoding = &Encoding{Name: EncodingMsgpack, binary: true, marshal: marshalMsgpack, unmarshal: unmarshalMsgpack}
+
+	case EncodingCBOR:
+		encoding = &Encoding{Name: EncodingCBOR, binary: true, marshal: cborEncoder.Marshal, unmarshal: cborDecoder.Unmarshal}
+
+	default:
+		return nil, newError(ErrorInvalidField, "encoding", fmt.Sprintf("Unknown encoding `%s`, expected json, msgpack or cbor", name))
+	}
+
+	switch compress := query.Get("compress"); compress {
+	case "":
+		break
+
+	case CompressZlib:
+		encoding.Compress = true
+
+	default:
+		return nil, newError(ErrorInvalidField, "compress", fmt.Sprintf("Unknown compression `%s`, expected zlib", compress))
+	}
+
+	return encoding, nil
+}
+
+func marshalMsgpack(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := msgpack.NewEncoder(&buffer)
+	encoder.SetCustomStructTag("json")
+	encoder.UseCompactInts(true)
+
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func unmarshalMsgpack(data []byte, v interface{}) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+
+	return decoder.Decode(v)
+}
+
+// Encode returns the frame type and data of the message.
+func (e *Encoding) Encode(msg Message) (int, []byte, error) {
+	data, err := e.marshal(msg)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if !e.Compress {
+		if e.binary {
+			return websocket.BinaryMessage, data, nil
+		}
+
+		return websocket.TextMessage, data, nil
+	}
+
+	var buffer bytes.Buffer
+	writer := zlib.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		return 0, nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return 0, nil, err
+	}
+
+	return websocket.BinaryMessage, buffer.Bytes(), nil
+}
+
+// Decode reads a message sent by the client. With zlib compression, clients can send
+// compressed and uncompressed messages, which are told apart by the zlib header.
+func (e *Encoding) Decode(data []byte, msg *Message) error {
+	// No encoding starts a message with 0x78, JSON starts with `{` and the others with a map
+	if e.Compress && len(data) > 0 && data[0] == 0x78 {
+		reader, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+
+		defer reader.Close()
+
+		data, err = io.ReadAll(io.LimitReader(reader, maxDecompressedSize+1))
+		if err != nil {
+			return err
+		}
+
+		if len(data) > maxDecompressedSize {
+			return fmt.Errorf("message is larger than %d bytes once decompressed", maxDecompressedSize)
+		}
+	}
+
+	return e.unmarshal(data, msg)
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"bytes"
+	"compress/zlib"
+	"github.com/gorilla/websocket"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncodingFor(t *testing.T) {
+	tests := []struct {
+		query        string
+		wantName     string
+		wantCompress bool
+		wantErr      bool
+	}{
+		{"", EncodingJSON, false, false},
+		{"encoding=json", EncodingJSON, false, false},
+		{"encoding=msgpack", EncodingMsgpack, false, false},
+		{"encoding=cbor&compress=zlib", EncodingCBOR, true, false},
+		{"compress=zlib", EncodingJSON, true, false},
+		{"encoding=xml", "", false, true},
+		{"compress=gzip", "", false, true},
+	}
+
+	for _, test := range tests {
+		encoding, err := encodingFor(httptest.NewRequest("GET", "/?"+test.query, nil))
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("encodingFor(%q) = %+v, want an error", test.query, encoding)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("encodingFor(%q) error = %v", test.query, err)
+			continue
+		}
+
+		if encoding.Name != test.wantName || encoding.Compress != test.wantCompress {
+			t.Errorf("encodingFor(%q) = %s, %v, want %s, %v", test.query, encoding.Name, encoding.Compress, test.wantName, test.wantCompress)
+		}
+	}
+}
+
+func testEncoding(t *testing.T, name string, compress bool) *Encoding {
+	query := "encoding=" + name
+	if compress {
+		query += "&compress=zlib"
+	}
+
+	encoding, err := encodingFor(httptest.NewRequest("GET", "/?"+query, nil))
+	if err != nil {
+		t.Fatalf("encodingFor(%q) error = %v", query, err)
+	}
+
+	return encoding
+}
+
+func TestEncodingRoundTrip(t *testing.T) {
+	msg := Message{
+		OP:    Request,
+		Data:  map[string]interface{}{"guild_id": "1", "user_id": "2", "type": "mute"},
+		Nonce: "nonce",
+		Seq:   5,
+	}
+
+	for _, name := range []string{EncodingJSON, EncodingMsgpack, EncodingCBOR} {
+		for _, compress := range []bool{false, true} {
+			encoding := testEncoding(t, name, compress)
+			frame, data, err := encoding.Encode(msg)
+			if err != nil {
+				t.Fatalf("%s (compress: %v): Encode() error = %v", name, compress, err)
+			}
+
+			wantFrame := websocket.BinaryMessage
+			if name == EncodingJSON && !compress {
+				wantFrame = websocket.TextMessage
+			}
+
+			if frame != wantFrame {
+				t.Errorf("%s (compress: %v): Encode() frame = %d, want %d", name, compress, frame, wantFrame)
+			}
+
+			var decoded Message
+			if err := encoding.Decode(data, &decoded); err != nil {
+				t.Fatalf("%s (compress: %v): Decode() error = %v", name, compress, err)
+			}
+
+			if decoded.OP != msg.OP || decoded.Nonce != msg.Nonce || decoded.Seq != msg.Seq || !reflect.DeepEqual(decoded.Data, msg.Data) {
+				t.Errorf("%s (compress: %v): Decode() = %+v, want %+v", name, compress, decoded, msg)
+			}
+		}
+	}
+}
+
+func TestEncodingDecodesUncompressed(t *testing.T) {
+	for _, name := range []string{EncodingJSON, EncodingMsgpack, EncodingCBOR} {
+		_, data, err := testEncoding(t, name, false).Encode(Message{OP: Heartbeat, Nonce: "nonce"})
+		if err != nil {
+			t.Fatalf("%s: Encode() error = %v", name, err)
+		}
+
+		// Clients with compression may still send uncompressed messages
+		var decoded Message
+		if err := testEncoding(t, name, true).Decode(data, &decoded); err != nil {
+			t.Fatalf("%s: Decode() error = %v", name, err)
+		}
+
+		if decoded.OP != Heartbeat || decoded.Nonce != "nonce" {
+			t.Errorf("%s: Decode() = %+v, want the heartbeat", name, decoded)
+		}
+	}
+}
+
+func compress(t *testing.T, data string) []byte {
+	var buffer bytes.Buffer
+	writer := zlib.NewWriter(&buffer)
+	if _, err := writer.Write([]byte(data)); err != nil {
+		t.Fatalf("Unable to compress: %v", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Unable to compress: %v", err)
+	}
+
+	return buffer.Bytes()
+}
+
+func TestEncodingDecompressionLimit(t *testing.T) {
+	encoding := testEncoding(t, EncodingJSON, true)
+	message := func(size int) string {
+		// `{"d":""}` takes up the other 8 bytes
+		return `{"d":"` + strings.Repeat("a", size-8) + `"}`
+	}
+
+	var decoded Message
+	if err := encoding.Decode(compress(t, message(maxDecompressedSize)), &decoded); err != nil {
+		t.Errorf("Decode() at the limit error = %v", err)
+	}
+
+	if err := encoding.Decode(compress(t, message(maxDecompressedSize+1)), &decoded); err == nil {
+		t.Errorf("Decode() over the limit error = nil, want an error")
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"github.com/sirupsen/logrus"
+	"os"
+	"strconv"
+	"time"
+)
+
+func envString(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		logrus.Warnf("Unable to parse `%s` as an integer, using default %d: %v", key, fallback, err)
+		return fallback
+	}
+
+	return parsed
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		logrus.Warnf("Unable to parse `%s` as a duration, using default %s: %v", key, fallback, err)
+		return fallback
+	}
+
+	return parsed
+}
+
+// envPositiveInt is like `envInt`, but falls back to the default if the value isn't
+// greater than 0, for sizes that would break or divide by zero otherwise.
+func envPositiveInt(key string, fallback int) int {
+	value := envInt(key, fallback)
+	if value <= 0 {
+		logrus.Warnf("`%s` must be greater than 0, using default %d", key, fallback)
+		return fallback
+	}
+
+	return value
+}
+
+// envPositiveDuration is like `envDuration`, but falls back to the default if the value
+// isn't greater than 0, for intervals and timeouts that can't be 0.
+func envPositiveDuration(key string, fallback time.Duration) time.Duration {
+	value := envDuration(key, fallback)
+	if value <= 0 {
+		logrus.Warnf("`%s` must be greater than 0, using default %s", key, fallback)
+		return fallback
+	}
+
+	return value
+}
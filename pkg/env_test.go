@@ -0,0 +1,55 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnvPositive(t *testing.T) {
+	tests := []struct {
+		value        string
+		wantInt      int
+		wantDuration time.Duration
+	}{
+		{"", 10, time.Second},
+		{"0", 10, time.Second},
+		{"-5", 10, time.Second},
+		{"-5s", 10, time.Second},
+		{"garbage", 10, time.Second},
+		{"3", 3, time.Second},
+		{"3s", 10, 3 * time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			t.Setenv("TEST_POSITIVE", test.value)
+			if got := envPositiveInt("TEST_POSITIVE", 10); got != test.wantInt {
+				t.Errorf("envPositiveInt(%q) = %d, want %d", test.value, got, test.wantInt)
+			}
+
+			if got := envPositiveDuration("TEST_POSITIVE", time.Second); got != test.wantDuration {
+				t.Errorf("envPositiveDuration(%q) = %s, want %s", test.value, got, test.wantDuration)
+			}
+		})
+	}
+}
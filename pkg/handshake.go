@@ -0,0 +1,186 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	// CapabilityAck means the client acknowledges `Apply` events with `Ack`, otherwise
+	// they are acknowledged as soon as they're sent.
+	CapabilityAck = "ack"
+)
+
+var supportedCapabilities = []string{CapabilityAck}
+
+// HandleHandshake handles the messages of a client that didn't identify yet, which can
+// only send `Identify`, `Resume` and `Heartbeat`.
+func (c *Client) HandleHandshake(msg Message) {
+	switch msg.OP {
+	case Identify:
+		c.identify(msg)
+
+	case Resume:
+		c.resume(msg)
+
+	case Heartbeat:
+		c.Reply(msg, HeartbeatAck, nil)
+
+	default:
+		c.WriteError(msg, newError(ErrorUnauthorized, "op", "`Identify` or `Resume` must be sent first"))
+	}
+}
+
+// authenticate checks the token sent in the handshake, or uses the one the client
+// connected with if there wasn't one. A client that connected with a token can't
+// identify as another one.
+func (c *Client) authenticate(secret string) bool {
+	token := c.connectedAs
+	if secret != "" {
+		sent := Tokens.Authenticate(secret)
+		if sent == nil || (token != nil && sent.Name != token.Name) {
+			return false
+		}
+
+		token = sent
+	}
+
+	if token == nil {
+		return false
+	}
+
+	c.Token = token
+	logrus.Infof("Client from %s authenticated with token %s", c.RemoteAddr, token.Name)
+
+	return true
+}
+
+// register makes the client receive the `Apply` events of its shard, which is only
+// done for tokens that can write, others can only query.
+func (c *Client) register() {
+	if !c.Token.Allows(ScopeWrite) {
+		logrus.Infof("Token %s can't write, not sending any events to the client from %s", c.Token.Name, c.RemoteAddr)
+		return
+	}
+
+	Server.addClient(c)
+}
+
+func (c *Client) reject(msg Message) {
+	Access.Reject("auth")
+	logrus.Warnf("Client from %s sent a bad authentication token, closing connection", c.RemoteAddr)
+	c.WriteError(msg, newError(ErrorUnauthorized, "token", "Invalid authentication token"))
+	_ = c.Conn.Close()
+}
+
+func (c *Client) identify(msg Message) {
+	var req IdentifyRequest
+	if err := decodeData(msg.Data, &req); err != nil {
+		c.WriteError(msg, err)
+		return
+	}
+
+	if err := validateIdentify(req); err != nil {
+		c.WriteError(msg, err)
+		return
+	}
+
+	if !c.authenticate(req.Token) {
+		c.reject(msg)
+		return
+	}
+
+	c.Name = req.Client.Name
+	c.Version = req.Client.Version
+	c.ConnectedAt = time.Now()
+	if len(req.Shard) == 2 {
+		c.ShardId, c.ShardCount = req.Shard[0], req.Shard[1]
+	}
+
+	c.Capabilities = []string{}
+	for _, capability := range req.Capabilities {
+		for _, supported := range supportedCapabilities {
+			if capability == supported {
+				c.Capabilities = append(c.Capabilities, capability)
+			}
+		}
+	}
+
+	session := Server.createSession(c)
+	c.setIdentified()
+	logrus.Infof("Shard #%d (of %d) has connected (client=%s v%s)", c.ShardId, c.ShardCount, c.Name, c.Version)
+
+	// The bot needs its session before the first event, events dispatched in the meantime
+	// are queued and replayed below
+	c.Reply(msg, Ready, ReadyData{
+		SessionId:    session.Id,
+		ShardId:      c.ShardId,
+		ShardCount:   c.ShardCount,
+		Capabilities: c.Capabilities,
+	})
+
+	c.register()
+	if c.Token.Allows(ScopeWrite) {
+		Server.replay(c)
+	}
+}
+
+func (c *Client) resume(msg Message) {
+	var req ResumeRequest
+	if err := decodeData(msg.Data, &req); err != nil {
+		c.WriteError(msg, err)
+		return
+	}
+
+	if req.SessionId == "" {
+		c.WriteError(msg, newError(ErrorInvalidField, "session_id", "`session_id` is required"))
+		return
+	}
+
+	if !c.authenticate(req.Token) {
+		c.reject(msg)
+		return
+	}
+
+	c.ConnectedAt = time.Now()
+	replayed, ok := Server.resume(c, req)
+	if !ok {
+		logrus.Infof("Client from %s couldn't resume session %s", c.RemoteAddr, req.SessionId)
+		c.Reply(msg, InvalidSession, nil)
+
+		return
+	}
+
+	c.setIdentified()
+	c.register()
+	logrus.Infof("Shard #%d resumed session %s, replayed %d events", c.ShardId, req.SessionId, replayed)
+
+	c.Reply(msg, Resumed, ResumedData{
+		SessionId: req.SessionId,
+		Replayed:  replayed,
+	})
+
+	if c.Token.Allows(ScopeWrite) {
+		Server.replay(c)
+	}
+}
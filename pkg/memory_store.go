@@ -0,0 +1,338 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps everything in memory, which is meant for tests and local development
+// since everything is lost once the service stops.
+type MemoryStore struct {
+	mutex    *sync.Mutex
+	timeouts map[string]Timeout
+
+	// deliveries are the timeouts that were applied, waiting to be acknowledged
+	deliveries map[string]*memoryDelivery
+	queue      []string
+}
+
+type memoryDelivery struct {
+	timeout  Timeout
+	attempt  int
+	deadline int64
+}
+
+func newMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		mutex:      &sync.Mutex{},
+		timeouts:   map[string]Timeout{},
+		deliveries: map[string]*memoryDelivery{},
+	}
+}
+
+func (m *MemoryStore) Store(t Timeout) (Timeout, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for id, other := range m.timeouts {
+		if id != t.Id && other.GuildId == t.GuildId && other.UserId == t.UserId && other.Type == t.Type {
+			t.Id = id
+			break
+		}
+	}
+
+	_, replaced := m.timeouts[t.Id]
+	m.timeouts[t.Id] = t
+
+	return t, replaced, nil
+}
+
+func (m *MemoryStore) Get(id string) (*Timeout, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	t, ok := m.timeouts[id]
+	if !ok {
+		return nil, nil
+	}
+
+	return &t, nil
+}
+
+func (m *MemoryStore) Find(q QueryRequest) ([]Timeout, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	timeouts := []Timeout{}
+	for _, t := range m.timeouts {
+		if matches(t, q) {
+			timeouts = append(timeouts, t)
+		}
+	}
+
+	return timeouts, nil
+}
+
+func (m *MemoryStore) Page(q QueryRequest) (QueryResponse, error) {
+	timeouts, _ := m.Find(q)
+	return pageOf(timeouts, q), nil
+}
+
+func (m *MemoryStore) Scan(size int, fn func(timeouts []Timeout) error) error {
+	// Copy them first, so `fn` can take its time without blocking everything else
+	timeouts, _ := m.Find(QueryRequest{})
+	for start := 0; start < len(timeouts); start += size {
+		end := start + size
+		if end > len(timeouts) {
+			end = len(timeouts)
+		}
+
+		if err := fn(timeouts[start:end]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) Count() (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return len(m.timeouts), nil
+}
+
+func (m *MemoryStore) Cancel(id string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, ok := m.timeouts[id]
+	delete(m.timeouts, id)
+
+	return ok, nil
+}
+
+func (m *MemoryStore) Update(id string, change func(t Timeout) (Timeout, error)) (*Timeout, *Timeout, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	t, ok := m.timeouts[id]
+	if !ok {
+		return nil, nil, nil
+	}
+
+	updated, err := change(t)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m.timeouts[id] = updated
+	return &t, &updated, nil
+}
+
+func (m *MemoryStore) Due(now int64, limit int) ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var due []Timeout
+	for _, t := range m.timeouts {
+		if t.ExpiresAt <= now {
+			due = append(due, t)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].ExpiresAt < due[j].ExpiresAt
+	})
+
+	ids := []string{}
+	for _, t := range due {
+		if len(ids) == limit {
+			break
+		}
+
+		ids = append(ids, t.Id)
+	}
+
+	return ids, nil
+}
+
+func (m *MemoryStore) Claim(id string, now int64, deliveryId string, deadline int64) (*Timeout, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	t, ok := m.timeouts[id]
+	if !ok || t.ExpiresAt > now {
+		return nil, nil
+	}
+
+	delete(m.timeouts, id)
+	m.deliveries[deliveryId] = &memoryDelivery{timeout: t, attempt: 1, deadline: deadline}
+
+	return &t, nil
+}
+
+func (m *MemoryStore) Unacknowledged(now int64, limit int) ([]Delivery, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var ids []string
+	for id, delivery := range m.deliveries {
+		if delivery.deadline <= now {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return m.deliveries[ids[i]].deadline < m.deliveries[ids[j]].deadline
+	})
+
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	deliveries := make([]Delivery, 0, len(ids))
+	for _, id := range ids {
+		deliveries = append(deliveries, Delivery{
+			Timeout:    m.deliveries[id].timeout,
+			DeliveryId: id,
+			Attempt:    m.deliveries[id].attempt,
+		})
+	}
+
+	return deliveries, nil
+}
+
+func (m *MemoryStore) Redeliver(deliveryId string, now int64, backoff time.Duration, maxBackoff time.Duration) (*Delivery, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delivery, ok := m.deliveries[deliveryId]
+	if !ok || delivery.deadline > now {
+		return nil, nil
+	}
+
+	delivery.attempt++
+	delivery.deadline = backoffFor(now, delivery.attempt, backoff, maxBackoff)
+
+	return &Delivery{
+		Timeout:    delivery.timeout,
+		DeliveryId: deliveryId,
+		Attempt:    delivery.attempt,
+	}, nil
+}
+
+func (m *MemoryStore) Ack(deliveryId string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, ok := m.deliveries[deliveryId]
+	delete(m.deliveries, deliveryId)
+	m.dequeue(deliveryId)
+
+	return ok, nil
+}
+
+func (m *MemoryStore) Enqueue(deliveryId string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.dequeue(deliveryId)
+	m.queue = append(m.queue, deliveryId)
+	if delivery, ok := m.deliveries[deliveryId]; ok {
+		delivery.deadline = queuedDeadline
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) Queued() ([]Delivery, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var deliveries []Delivery
+	queue := m.queue[:0]
+	for _, id := range m.queue {
+		delivery, ok := m.deliveries[id]
+		if !ok {
+			continue
+		}
+
+		queue = append(queue, id)
+		deliveries = append(deliveries, Delivery{
+			Timeout:    delivery.timeout,
+			DeliveryId: id,
+			Attempt:    delivery.attempt,
+		})
+	}
+
+	m.queue = queue
+	return deliveries, nil
+}
+
+func (m *MemoryStore) Dequeue(deliveryId string, deadline int64) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.dequeue(deliveryId) {
+		return false, nil
+	}
+
+	if delivery, ok := m.deliveries[deliveryId]; ok {
+		delivery.deadline = deadline
+	}
+
+	return true, nil
+}
+
+func (m *MemoryStore) dequeue(deliveryId string) bool {
+	for i, id := range m.queue {
+		if id == deliveryId {
+			m.queue = append(m.queue[:i], m.queue[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *MemoryStore) QueueLength() (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return len(m.queue), nil
+}
+
+// Rehydrate has nothing to do, since nothing survives a restart.
+func (m *MemoryStore) Rehydrate(int64) (int, []string, error) {
+	return 0, nil, nil
+}
+
+func (m *MemoryStore) Ping() error {
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
@@ -38,6 +38,36 @@ var (
 		Name: "nino_timeouts_average_ws_latency",
 		Help: "The latency to process a WebSocket message.",
 	})
+
+	RecoveredTimeoutsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nino_timeouts_recovered",
+		Help: "How many timeouts were recovered from Redis on startup, by whether they were re-armed or fired late.",
+	}, []string{"state"})
+
+	TokenUsageMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nino_timeouts_token_usage",
+		Help: "How many times each API token was used, by scope and whether it was allowed.",
+	}, []string{"token", "scope", "allowed"})
+
+	RejectionMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nino_timeouts_rejections",
+		Help: "How many connections, requests and messages were rejected, by reason.",
+	}, []string{"reason"})
+
+	DegradedMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "nino_timeouts_degraded",
+		Help: "Whether the storage is unavailable and writes are being buffered.",
+	})
+
+	BufferedWritesMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "nino_timeouts_buffered_writes",
+		Help: "How many writes are buffered until the storage is available again.",
+	})
+
+	RedeliveryMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "nino_timeouts_redeliveries",
+		Help: "How many applied timeouts were redelivered because the bot didn't acknowledge them in time.",
+	})
 )
 
 func SetupMetrics() bool {
@@ -55,7 +85,12 @@ func SetupMetrics() bool {
 
 	MetricsEnabled = true
 	logrus.Infof("Now setting up collector registry...")
-	prometheus.MustRegister(TimeoutMetric, TimeoutLatencyMetric)
+	prometheus.MustRegister(TimeoutMetric, TimeoutLatencyMetric, RecoveredTimeoutsMetric, RedeliveryMetric, TokenUsageMetric, RejectionMetric, DegradedMetric, BufferedWritesMetric)
+
+	// The store is created first, and may be degraded already
+	if buffered, ok := Store.(*BufferedStore); ok {
+		buffered.reportMetrics()
+	}
 
 	return true
 }
@@ -0,0 +1,351 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// migration upgrades the timeouts stored in Redis from the previous schema version to
+// `version`. It returns how many timeouts it changed, or would change in a dry run, in
+// which case it must not write anything. Migrations must be safe to run again if they
+// were interrupted.
+type migration struct {
+	version     int
+	description string
+	run         func(r *RedisStore, dryRun bool) (int, error)
+}
+
+// migrations are run in order on startup, from the stored schema version. Data written
+// before schema versions were stored is at version 0.
+var migrations = []migration{
+	{1, "move the JSON array saved on shutdown into the timeouts hash", migrateJSONArray},
+	{2, "give timeouts keyed by `guild_id:user_id` an id and index them", migrateLegacyKeys},
+}
+
+const migrationLockTTL = time.Minute
+
+// Migrate upgrades the timeouts stored by older versions to the current layout. In a
+// dry run, it only logs what would be changed. Only Redis has older layouts, so it does
+// nothing for the other backends.
+func Migrate(dryRun bool) error {
+	if storageBackend != StorageRedis {
+		return nil
+	}
+
+	return newRedisStore().Migrate(dryRun)
+}
+
+// Migrate runs every migration newer than the stored schema version. Instances starting
+// at the same time take turns, so each migration only runs once.
+func (r *RedisStore) Migrate(dryRun bool) error {
+	latest := migrations[len(migrations)-1].version
+	var lock *migrationLock
+	if !dryRun {
+		var err error
+		lock, err = r.lockMigrations()
+		if err != nil {
+			return err
+		}
+
+		defer lock.Release()
+	}
+
+	current, err := r.schemaVersion()
+	if err != nil {
+		return err
+	}
+
+	if current > latest {
+		return fmt.Errorf("stored schema version %d is newer than the latest this version knows (%d), refusing to start", current, latest)
+	}
+
+	if current == latest {
+		logrus.Debugf("Stored timeouts are at schema version %d, nothing to migrate", current)
+		return nil
+	}
+
+	logrus.Infof("Stored timeouts are at schema version %d, migrating to %d", current, latest)
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		if lock != nil && lock.Lost() {
+			return fmt.Errorf("lost the migration lock before migration %d", m.version)
+		}
+
+		changed, err := m.run(r, dryRun)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.description, err)
+		}
+
+		if dryRun {
+			logrus.Infof("[dry run] Migration %d would %s, changing %d timeouts", m.version, m.description, changed)
+			continue
+		}
+
+		if err := r.client.Set(context.TODO(), r.keys.version, m.version, 0).Err(); err != nil {
+			return err
+		}
+
+		logrus.Infof("Migration %d: %s, changed %d timeouts", m.version, m.description, changed)
+	}
+
+	return nil
+}
+
+func (r *RedisStore) schemaVersion() (int, error) {
+	value, err := r.client.Get(context.TODO(), r.keys.version).Result()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version %q in %s", value, r.keys.version)
+	}
+
+	return version, nil
+}
+
+// migrationLock makes sure only one instance migrates at a time. It holds a random value
+// so only its owner can renew or release it, and is renewed in the background while
+// migrations run. It expires in case an instance dies while migrating.
+type migrationLock struct {
+	client redis.UniversalClient
+	key    string
+	value  string
+	stop   chan struct{}
+	done   chan struct{}
+	lost   int32
+}
+
+// renewLockScript extends the lock if it's still held by the given value.
+var renewLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseLockScript deletes the lock if it's still held by the given value.
+var releaseLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// lockMigrations waits until no other instance is migrating, and takes the lock.
+func (r *RedisStore) lockMigrations() (*migrationLock, error) {
+	lock := &migrationLock{
+		client: r.client,
+		key:    r.keys.version + ":lock",
+		value:  generateId(),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	for {
+		locked, err := r.client.SetNX(context.TODO(), lock.key, lock.value, migrationLockTTL).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		if locked {
+			break
+		}
+
+		logrus.Info("Another instance is migrating the stored timeouts, waiting for it to finish")
+		time.Sleep(time.Second)
+	}
+
+	go lock.renew()
+	return lock, nil
+}
+
+func (l *migrationLock) renew() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(migrationLockTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+
+		case <-ticker.C:
+			renewed, err := renewLockScript.Run(context.TODO(), l.client, []string{l.key}, l.value, migrationLockTTL.Milliseconds()).Int()
+			if err != nil {
+				logrus.Warnf("Unable to renew the migration lock: %v", err)
+			} else if renewed == 0 {
+				logrus.Error("Lost the migration lock, another instance may be migrating")
+				atomic.StoreInt32(&l.lost, 1)
+				return
+			}
+		}
+	}
+}
+
+// Lost returns if the lock expired or was taken over, in which case we must stop migrating.
+func (l *migrationLock) Lost() bool {
+	return atomic.LoadInt32(&l.lost) == 1
+}
+
+// Release stops renewing the lock, and deletes it if we still hold it.
+func (l *migrationLock) Release() {
+	close(l.stop)
+	<-l.done
+
+	if err := releaseLockScript.Run(context.TODO(), l.client, []string{l.key}, l.value).Err(); err != nil {
+		logrus.Warnf("Unable to release the migration lock: %v", err)
+	}
+}
+
+// migrateJSONArray moves the JSON array that older versions saved into the timeouts key
+// on shutdown into the timeouts hash. The array is renamed out of the way first, so an
+// interrupted migration picks up where it left off.
+func migrateJSONArray(r *RedisStore, dryRun bool) (int, error) {
+	legacy := r.keys.timeouts + ":legacy"
+	kind, err := r.client.Type(context.TODO(), r.keys.timeouts).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	source := legacy
+	if kind == "string" {
+		source = r.keys.timeouts
+	}
+
+	data, err := r.client.Get(context.TODO(), source).Result()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	var queue []Timeout
+	if err := json.Unmarshal([]byte(data), &queue); err != nil {
+		return 0, fmt.Errorf("unable to decode the timeouts in %s: %w", source, err)
+	}
+
+	if dryRun {
+		return len(queue), nil
+	}
+
+	if source == r.keys.timeouts {
+		if err := r.client.Rename(context.TODO(), r.keys.timeouts, legacy).Err(); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, t := range queue {
+		if t.Id == "" {
+			t.Id = generateId()
+		}
+
+		if _, _, err := r.Store(t); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(queue), r.client.Del(context.TODO(), legacy).Err()
+}
+
+// migrateLegacyKeys re-stores the timeouts that older versions keyed by
+// `guild_id:user_id` under an id, with their schedule and indexes.
+func migrateLegacyKeys(r *RedisStore, dryRun bool) (int, error) {
+	// In a dry run, the JSON array hasn't actually been moved into a hash
+	kind, err := r.client.Type(context.TODO(), r.keys.timeouts).Result()
+	if err != nil || kind != "hash" {
+		return 0, err
+	}
+
+	legacy := map[string]Timeout{}
+	var cursor uint64
+	for {
+		var data []string
+		data, cursor, err = r.client.HScan(context.TODO(), r.keys.timeouts, cursor, "", 500).Result()
+		if err != nil {
+			return 0, err
+		}
+
+		for i := 0; i+1 < len(data); i += 2 {
+			var t Timeout
+			if err := json.Unmarshal([]byte(data[i+1]), &t); err != nil {
+				logrus.Warnf("Unable to decode stored timeout %s, skipping", data[i])
+				continue
+			}
+
+			if t.Id == "" {
+				legacy[data[i]] = t
+			}
+		}
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	if dryRun {
+		return len(legacy), nil
+	}
+
+	for key, t := range legacy {
+		// Unindex it first, otherwise it'd be found as the timeout to replace
+		pipe := r.client.Pipeline()
+		pipe.ZRem(context.TODO(), r.keys.schedule, key)
+		pipe.SRem(context.TODO(), r.keys.index+"guild:"+t.GuildId, key)
+		pipe.SRem(context.TODO(), r.keys.index+"user:"+t.UserId, key)
+		pipe.SRem(context.TODO(), r.keys.index+"type:"+t.Type, key)
+		pipe.SRem(context.TODO(), r.keys.index+"moderator:"+t.ModeratorId, key)
+		if _, err := pipe.Exec(context.TODO()); err != nil {
+			return 0, err
+		}
+
+		t.Id = generateId()
+		if _, _, err := r.Store(t); err != nil {
+			return 0, err
+		}
+
+		if err := r.client.HDel(context.TODO(), r.keys.timeouts, key).Err(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(legacy), nil
+}
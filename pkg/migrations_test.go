@@ -0,0 +1,287 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"encoding/json"
+	"github.com/alicebob/miniredis/v2"
+	"strconv"
+	"testing"
+)
+
+func legacyTimeouts() []Timeout {
+	return []Timeout{
+		testTimeout("", "1", "2", "mute", 100),
+		testTimeout("", "1", "3", "ban", 200),
+		testTimeout("", "5", "4", "mute", 300),
+	}
+}
+
+func encodeTimeouts(t *testing.T, timeouts []Timeout) string {
+	data, err := json.Marshal(timeouts)
+	if err != nil {
+		t.Fatalf("Unable to encode timeouts: %v", err)
+	}
+
+	return string(data)
+}
+
+// setLegacyHash stores the timeouts the way older versions did, keyed by
+// `guild_id:user_id` and without ids.
+func setLegacyHash(t *testing.T, r *RedisStore, mr *miniredis.Miniredis, timeouts []Timeout) {
+	for _, timeout := range timeouts {
+		key := timeout.GuildId + ":" + timeout.UserId
+		data, err := json.Marshal(timeout)
+		if err != nil {
+			t.Fatalf("Unable to encode timeout: %v", err)
+		}
+
+		mr.HSet(r.keys.timeouts, key, string(data))
+		if _, err := mr.ZAdd(r.keys.schedule, float64(timeout.ExpiresAt), key); err != nil {
+			t.Fatalf("Unable to schedule timeout: %v", err)
+		}
+
+		if _, err := mr.SAdd(r.keys.index+"guild:"+timeout.GuildId, key); err != nil {
+			t.Fatalf("Unable to index timeout: %v", err)
+		}
+	}
+}
+
+// checkMigrated checks that the store holds exactly the given timeouts in the current
+// layout, and returns their ids.
+func checkMigrated(t *testing.T, r *RedisStore, mr *miniredis.Miniredis, want []Timeout) map[string]bool {
+	t.Helper()
+
+	version, err := mr.Get(r.keys.version)
+	if err != nil || version != strconv.Itoa(migrations[len(migrations)-1].version) {
+		t.Errorf("Schema version = %q (%v), want %d", version, err, migrations[len(migrations)-1].version)
+	}
+
+	for _, key := range []string{r.keys.timeouts + ":legacy", r.keys.version + ":lock"} {
+		if mr.Exists(key) {
+			t.Errorf("%s wasn't deleted", key)
+		}
+	}
+
+	fields, err := mr.HKeys(r.keys.timeouts)
+	if err != nil {
+		t.Fatalf("Unable to list the stored timeouts: %v", err)
+	}
+
+	if len(fields) != len(want) {
+		t.Errorf("Stored %d timeouts (%v), want %d", len(fields), fields, len(want))
+	}
+
+	ids := map[string]bool{}
+	for _, field := range fields {
+		var stored Timeout
+		if err := json.Unmarshal([]byte(mr.HGet(r.keys.timeouts, field)), &stored); err != nil || stored.Id != field {
+			t.Errorf("Timeout stored at %s has id %q (%v)", field, stored.Id, err)
+		}
+
+		ids[field] = true
+	}
+
+	members, err := mr.ZMembers(r.keys.schedule)
+	if err != nil || len(members) != len(want) {
+		t.Errorf("Schedule = %v (%v), want %d timeouts", members, err, len(want))
+	}
+
+	guilds := map[string]int{}
+	for _, timeout := range want {
+		guilds[timeout.GuildId]++
+
+		found, err := r.Find(QueryRequest{GuildId: timeout.GuildId, UserId: timeout.UserId, Type: timeout.Type})
+		if err != nil || len(found) != 1 {
+			t.Errorf("Find(%s, %s, %s) = %v (%v), want 1 timeout", timeout.GuildId, timeout.UserId, timeout.Type, found, err)
+			continue
+		}
+
+		if !ids[found[0].Id] {
+			t.Errorf("Found timeout %s isn't stored", found[0].Id)
+		}
+
+		score, err := mr.ZScore(r.keys.schedule, found[0].Id)
+		if err != nil || int64(score) != timeout.ExpiresAt {
+			t.Errorf("Timeout %s is scheduled at %v (%v), want %d", found[0].Id, score, err, timeout.ExpiresAt)
+		}
+
+		found[0].Id = ""
+		if found[0] != timeout {
+			t.Errorf("Migrated timeout = %+v, want %+v", found[0], timeout)
+		}
+	}
+
+	for guild, count := range guilds {
+		members, err := mr.Members(r.keys.index + "guild:" + guild)
+		if err != nil || len(members) != count {
+			t.Errorf("Guild %s index = %v (%v), want %d timeouts", guild, members, err, count)
+		}
+
+		for _, member := range members {
+			if !ids[member] {
+				t.Errorf("Guild %s index has unknown member %s", guild, member)
+			}
+		}
+	}
+
+	return ids
+}
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, r *RedisStore, mr *miniredis.Miniredis)
+	}{
+		{
+			name: "json array",
+			setup: func(t *testing.T, r *RedisStore, mr *miniredis.Miniredis) {
+				if err := mr.Set(r.keys.timeouts, encodeTimeouts(t, legacyTimeouts())); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "interrupted json array",
+			setup: func(t *testing.T, r *RedisStore, mr *miniredis.Miniredis) {
+				// The array was moved out of the way, and some of it was stored already
+				if err := mr.Set(r.keys.timeouts+":legacy", encodeTimeouts(t, legacyTimeouts())); err != nil {
+					t.Fatal(err)
+				}
+
+				if _, _, err := r.Store(testTimeout(generateId(), "1", "2", "mute", 100)); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "guild:user hash",
+			setup: func(t *testing.T, r *RedisStore, mr *miniredis.Miniredis) {
+				setLegacyHash(t, r, mr, legacyTimeouts()[:2:2])
+				if _, _, err := r.Store(testTimeout(generateId(), "5", "4", "mute", 300)); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := mr.Set(r.keys.version, "1"); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "guild:user hash without version",
+			setup: func(t *testing.T, r *RedisStore, mr *miniredis.Miniredis) {
+				setLegacyHash(t, r, mr, legacyTimeouts())
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, mr := newTestRedisStore(t)
+			test.setup(t, r, mr)
+
+			if err := r.Migrate(false); err != nil {
+				t.Fatalf("Migrate() failed: %v", err)
+			}
+
+			ids := checkMigrated(t, r, mr, legacyTimeouts())
+
+			// Running it again, even from scratch as if it was interrupted before the
+			// version was stored, must not change anything
+			for _, version := range []string{"", "0", "1"} {
+				if version == "" {
+					mr.Del(r.keys.version)
+				} else if err := mr.Set(r.keys.version, version); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := r.Migrate(false); err != nil {
+					t.Fatalf("Migrate() from version %q failed: %v", version, err)
+				}
+
+				rerun := checkMigrated(t, r, mr, legacyTimeouts())
+				for id := range ids {
+					if !rerun[id] {
+						t.Errorf("Migrating again from version %q changed the ids: %v, want %v", version, rerun, ids)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, r *RedisStore, mr *miniredis.Miniredis)
+	}{
+		{
+			name: "json array",
+			setup: func(t *testing.T, r *RedisStore, mr *miniredis.Miniredis) {
+				if err := mr.Set(r.keys.timeouts, encodeTimeouts(t, legacyTimeouts())); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "guild:user hash",
+			setup: func(t *testing.T, r *RedisStore, mr *miniredis.Miniredis) {
+				setLegacyHash(t, r, mr, legacyTimeouts())
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, mr := newTestRedisStore(t)
+			test.setup(t, r, mr)
+			before := mr.Dump()
+
+			if err := r.Migrate(true); err != nil {
+				t.Fatalf("Migrate(true) failed: %v", err)
+			}
+
+			if after := mr.Dump(); after != before {
+				t.Errorf("Dry run changed the stored data:\n%s\nwant:\n%s", after, before)
+			}
+
+			if mr.Exists(r.keys.version) {
+				t.Error("Dry run stored a schema version")
+			}
+		})
+	}
+}
+
+func TestMigrateNewerVersion(t *testing.T) {
+	r, mr := newTestRedisStore(t)
+	if err := mr.Set(r.keys.version, strconv.Itoa(migrations[len(migrations)-1].version+1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Migrate(false); err == nil {
+		t.Error("Migrate() accepted a newer schema version")
+	}
+
+	if mr.Exists(r.keys.version + ":lock") {
+		t.Error("Migrate() didn't release the lock")
+	}
+}
@@ -22,10 +22,13 @@ package pkg
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"github.com/go-redis/redis/v8"
 	"github.com/sirupsen/logrus"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -34,8 +37,11 @@ import (
 
 var Redis *RedisClient
 
+// RedisClient is the connection to Redis, which is either a standalone server, a
+// Sentinel failover group or a cluster.
 type RedisClient struct {
-	Connection *redis.Client
+	Connection redis.UniversalClient
+	Keys       redisKeys
 }
 
 func NewRedis() error {
@@ -44,87 +50,158 @@ func NewRedis() error {
 	}
 
 	logrus.Info("Now connecting to Redis...")
-	index, err := strconv.Atoi(os.Getenv("REDIS_DB"))
+	options, err := redisOptions()
 	if err != nil {
 		return err
 	}
 
-	password := os.Getenv("REDIS_PASSWORD")
-
-	var connection *redis.Client
-	if sentinels := os.Getenv("REDIS_SENTINELS"); sentinels != "" {
-		hosts := strings.Split(os.Getenv("REDIS_SENTINELS"), ";")
-		connection = redis.NewFailoverClient(&redis.FailoverOptions{
-			SentinelAddrs: hosts,
-			MasterName:    os.Getenv("REDIS_MASTER"),
-			Password:      password,
-			DB:            index,
-			DialTimeout:   10 * time.Second,
-			ReadTimeout:   15 * time.Second,
-			WriteTimeout:  15 * time.Second,
-		})
+	var connection redis.UniversalClient
+	cluster := false
+	if addrs := os.Getenv("REDIS_CLUSTER_ADDRS"); addrs != "" {
+		// Clusters don't have databases
+		cluster = true
+		options.Addrs = strings.Split(addrs, ";")
+		connection = redis.NewClusterClient(options.Cluster())
+	} else if sentinels := os.Getenv("REDIS_SENTINELS"); sentinels != "" {
+		options.Addrs = strings.Split(sentinels, ";")
+		options.MasterName = os.Getenv("REDIS_MASTER")
+		connection = redis.NewFailoverClient(options.Failover())
 	} else {
-		host := os.Getenv("REDIS_HOST")
-		port := os.Getenv("REDIS_PORT")
-		connection = redis.NewClient(&redis.Options{
-			Addr:         fmt.Sprintf("%s:%s", host, port),
-			Password:     password,
-			DB:           index,
-			DialTimeout:  10 * time.Second,
-			ReadTimeout:  15 * time.Second,
-			WriteTimeout: 15 * time.Second,
-		})
+		if len(options.Addrs) == 0 {
+			options.Addrs = []string{fmt.Sprintf("%s:%s", envString("REDIS_HOST", "localhost"), envString("REDIS_PORT", "6379"))}
+		}
+
+		connection = redis.NewClient(options.Simple())
 	}
 
 	if err := connection.Ping(context.TODO()).Err(); err != nil {
+		_ = connection.Close()
 		return err
+	} else if cluster {
+		logrus.Info("Connected to the Redis cluster!")
 	} else {
 		logrus.Info("Connected to Redis!")
 	}
 
 	Redis = &RedisClient{
 		Connection: connection,
+		Keys:       newRedisKeys(envString("REDIS_KEY_PREFIX", "nino:timeouts"), cluster),
 	}
 
 	return nil
 }
 
-func (r RedisClient) Connect() error {
-	logrus.Info("Now connecting to Redis...")
-	index, err := strconv.Atoi(os.Getenv("REDIS_DB"))
+// redisOptions builds the options shared by every kind of connection. `REDIS_URL` sets
+// the address of a standalone server, and anything it contains takes precedence over
+// the other variables, including a database of `/0` over `REDIS_DB`.
+func redisOptions() (*redis.UniversalOptions, error) {
+	options := &redis.UniversalOptions{
+		Username:     os.Getenv("REDIS_USERNAME"),
+		Password:     os.Getenv("REDIS_PASSWORD"),
+		DialTimeout:  envDuration("REDIS_DIAL_TIMEOUT", 10*time.Second),
+		ReadTimeout:  envDuration("REDIS_READ_TIMEOUT", 15*time.Second),
+		WriteTimeout: envDuration("REDIS_WRITE_TIMEOUT", 15*time.Second),
+		PoolSize:     envInt("REDIS_POOL_SIZE", 0),
+		MinIdleConns: envInt("REDIS_MIN_IDLE_CONNS", 0),
+		PoolTimeout:  envDuration("REDIS_POOL_TIMEOUT", 0),
+	}
+
+	if db := os.Getenv("REDIS_DB"); db != "" {
+		index, err := strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("`REDIS_DB` has to be a database index: %v", err)
+		}
+
+		options.DB = index
+	}
+
+	if value := os.Getenv("REDIS_URL"); value != "" {
+		parsed, err := redis.ParseURL(value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse `REDIS_URL`: %v", err)
+		}
+
+		options.Addrs = []string{parsed.Addr}
+		options.TLSConfig = parsed.TLSConfig
+		if parsed.Username != "" {
+			options.Username = parsed.Username
+		}
+
+		if parsed.Password != "" {
+			options.Password = parsed.Password
+		}
+
+		// A database of 0 can't be told apart from none, so check if the URL has one
+		if path, _ := url.Parse(value); path != nil && strings.Trim(path.Path, "/") != "" {
+			options.DB = parsed.DB
+		}
+
+		if parsed.DialTimeout != 0 {
+			options.DialTimeout = parsed.DialTimeout
+		}
+
+		if parsed.ReadTimeout != 0 {
+			options.ReadTimeout = parsed.ReadTimeout
+		}
+
+		if parsed.WriteTimeout != 0 {
+			options.WriteTimeout = parsed.WriteTimeout
+		}
+
+		if parsed.PoolSize != 0 {
+			options.PoolSize = parsed.PoolSize
+		}
+
+		if parsed.MinIdleConns != 0 {
+			options.MinIdleConns = parsed.MinIdleConns
+		}
+	}
+
+	config, err := redisTLS(options.TLSConfig)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	password := os.Getenv("REDIS_PASSWORD")
-	if sentinels := os.Getenv("REDIS_SENTINELS"); sentinels != "" {
-		hosts := strings.Split(os.Getenv("REDIS_SENTINELS"), ";")
-		r.Connection = redis.NewFailoverClient(&redis.FailoverOptions{
-			SentinelAddrs: hosts,
-			MasterName:    os.Getenv("REDIS_MASTER"),
-			Password:      password,
-			DB:            index,
-			DialTimeout:   10 * time.Second,
-			ReadTimeout:   15 * time.Second,
-			WriteTimeout:  15 * time.Second,
-		})
-	} else {
-		host := os.Getenv("REDIS_HOST")
-		port := os.Getenv("REDIS_PORT")
-		r.Connection = redis.NewClient(&redis.Options{
-			Addr:         fmt.Sprintf("%s:%s", host, port),
-			Password:     password,
-			DB:           index,
-			DialTimeout:  10 * time.Second,
-			ReadTimeout:  15 * time.Second,
-			WriteTimeout: 15 * time.Second,
-		})
+	options.TLSConfig = config
+	return options, nil
+}
+
+// redisTLS adds the CA and client certificate files to the TLS config of the connection.
+// TLS is used with a `rediss://` URL, when `REDIS_TLS` is `true` or when any of the files
+// are set.
+func redisTLS(config *tls.Config) (*tls.Config, error) {
+	caFile := os.Getenv("REDIS_TLS_CA_FILE")
+	certFile := os.Getenv("REDIS_TLS_CERT_FILE")
+	keyFile := os.Getenv("REDIS_TLS_KEY_FILE")
+	if config == nil && os.Getenv("REDIS_TLS") != "true" && caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
 	}
 
-	if err := r.Connection.Ping(context.TODO()).Err(); err != nil {
-		return err
-	} else {
-		logrus.Info("Connected to Redis!")
-		return nil
+	if config == nil {
+		config = &tls.Config{}
 	}
+
+	config.MinVersion = tls.VersionTLS12
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the Redis client certificate: %v", err)
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
 }
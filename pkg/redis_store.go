@@ -0,0 +1,850 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+	"math"
+	"strconv"
+	"time"
+)
+
+// redisKeys are the keys timeouts are stored in, under `REDIS_KEY_PREFIX`. In cluster
+// mode, the prefix is a hash tag so every key lands in the same slot, which the scripts
+// and transactions need.
+type redisKeys struct {
+	timeouts  string
+	version   string
+	tokens    string
+	schedule  string
+	pending   string
+	deadlines string
+	attempts  string
+	queue     string
+	index     string
+	query     string
+}
+
+func newRedisKeys(prefix string, cluster bool) redisKeys {
+	if cluster {
+		prefix = "{" + prefix + "}"
+	}
+
+	return redisKeys{
+		timeouts:  prefix,
+		version:   prefix + ":version",
+		tokens:    prefix + ":tokens",
+		schedule:  prefix + ":schedule",
+		pending:   prefix + ":pending",
+		deadlines: prefix + ":pending:deadlines",
+		attempts:  prefix + ":pending:attempts",
+		queue:     prefix + ":queue",
+		index:     prefix + ":index:",
+		query:     prefix + ":query:",
+	}
+}
+
+// indexLua maintains the secondary indexes of a timeout, which are sets of timeout keys
+// per guild, user, type and moderator. It is prepended to every script that stores or
+// removes timeouts. The four index keys of a timeout are passed in `KEYS` starting at
+// `first`, since Redis Cluster only lets scripts touch declared keys.
+const indexLua = `
+local function index(command, member, first)
+	for i = first, first + 3 do
+		redis.call(command, KEYS[i], member)
+	end
+end
+`
+
+// changedLua is returned by the scripts when the timeout changed since its index keys
+// were read, the caller has to read it again and retry.
+const changedLua = -1
+
+// storeScript stores a timeout and schedules it. If the user already has a timeout of
+// the same type in the guild with another id, it returns that id instead so the caller
+// can replace it. Otherwise it returns the id and if a timeout was replaced. The index
+// keys of the new timeout are `KEYS[3..6]`, and the ones of the stored timeout it
+// replaces (which has to be `ARGV[4]`) are `KEYS[7..10]`.
+var storeScript = redis.NewScript(indexLua + `
+local existing = redis.call('SINTER', KEYS[3], KEYS[4], KEYS[5])
+for _, other in ipairs(existing) do
+	if other ~= ARGV[1] then
+		if redis.call('HEXISTS', KEYS[2], other) == 1 then
+			return {other, 0}
+		end
+
+		-- Stale index entry, the timeout doesn't exist anymore
+		redis.call('SREM', KEYS[3], other)
+		redis.call('SREM', KEYS[4], other)
+		redis.call('SREM', KEYS[5], other)
+	end
+end
+
+local old = redis.call('HGET', KEYS[2], ARGV[1]) or ''
+if old ~= ARGV[4] then
+	return {ARGV[1], -1}
+end
+
+if old ~= '' and #KEYS >= 10 then
+	index('SREM', ARGV[1], 7)
+end
+
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+index('SADD', ARGV[1], 3)
+return {ARGV[1], old ~= '' and 1 or 0}
+`)
+
+// claimScript atomically pops a due timeout off of the schedule and moves it into the
+// pending deliveries until it is acknowledged. It returns `false` if the timeout was
+// already claimed, cancelled or re-scheduled into the future. The stored timeout has to
+// be `ARGV[5]`, with its index keys in `KEYS[6..9]`.
+var claimScript = redis.NewScript(indexLua + `
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score or tonumber(score) > tonumber(ARGV[2]) then
+	return false
+end
+
+local data = redis.call('HGET', KEYS[2], ARGV[1])
+if not data then
+	redis.call('ZREM', KEYS[1], ARGV[1])
+	return false
+end
+
+if data ~= ARGV[5] or #KEYS < 9 then
+	return -1
+end
+
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+index('SREM', ARGV[1], 6)
+redis.call('HSET', KEYS[3], ARGV[3], data)
+redis.call('HSET', KEYS[5], ARGV[3], 1)
+redis.call('ZADD', KEYS[4], ARGV[4], ARGV[3])
+return data
+`)
+
+// redeliverScript bumps the attempt of an unacknowledged delivery and pushes its deadline
+// back exponentially. It returns `false` if the delivery was acknowledged in the meantime.
+var redeliverScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score or tonumber(score) > tonumber(ARGV[2]) then
+	return false
+end
+
+local data = redis.call('HGET', KEYS[2], ARGV[1])
+if not data then
+	redis.call('ZREM', KEYS[1], ARGV[1])
+	return false
+end
+
+local attempt = redis.call('HINCRBY', KEYS[3], ARGV[1], 1)
+local backoff = math.min(tonumber(ARGV[3]) * 2 ^ (attempt - 1), tonumber(ARGV[4]))
+redis.call('ZADD', KEYS[1], string.format('%d', tonumber(ARGV[2]) + backoff), ARGV[1])
+return {data, attempt}
+`)
+
+// rehydrateScript re-adds a stored timeout to the schedule and its index keys in
+// `KEYS[3..6]`, unless it was claimed, cancelled or changed since it was read as `ARGV[2]`.
+var rehydrateScript = redis.NewScript(indexLua + `
+if redis.call('HGET', KEYS[2], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+index('SADD', ARGV[1], 3)
+return 1
+`)
+
+// dequeueScript removes a delivery from the replay queue, and moves its deadline to
+// `ARGV[2]` if it was queued and is still pending.
+var dequeueScript = redis.NewScript(`
+if redis.call('LREM', KEYS[1], 0, ARGV[1]) == 0 then
+	return 0
+end
+
+redis.call('ZADD', KEYS[2], 'XX', ARGV[2], ARGV[1])
+return 1
+`)
+
+// cancelScript removes a pending timeout by its id. The stored timeout has to be
+// `ARGV[2]`, with its index keys in `KEYS[3..6]`.
+var cancelScript = redis.NewScript(indexLua + `
+local data = redis.call('HGET', KEYS[2], ARGV[1])
+if not data then
+	return 0
+end
+
+if data ~= ARGV[2] then
+	return -1
+end
+
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+index('SREM', ARGV[1], 3)
+return 1
+`)
+
+// updateScript replaces a scheduled timeout and reschedules it. The stored timeout has to
+// be `ARGV[2]`, with its index keys in `KEYS[3..6]`, and the index keys of the updated
+// timeout are `KEYS[7..10]`. It returns 0 if there is no such timeout or it isn't in the
+// schedule, in which case it's being applied right now.
+var updateScript = redis.NewScript(indexLua + `
+local data = redis.call('HGET', KEYS[2], ARGV[1])
+if not data or not redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	return 0
+end
+
+if data ~= ARGV[2] then
+	return -1
+end
+
+index('SREM', ARGV[1], 3)
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[3])
+redis.call('ZADD', KEYS[1], ARGV[4], ARGV[1])
+index('SADD', ARGV[1], 7)
+return 1
+`)
+
+// RedisStore keeps timeouts in a hash keyed by id, scheduled in a sorted set scored by
+// their `ExpiresAt`, with sets of ids per guild, user, type and moderator to query them.
+type RedisStore struct {
+	client redis.UniversalClient
+	keys   redisKeys
+}
+
+// indexKeys returns the index sets of the timeout, in the order the scripts expect them.
+func (r *RedisStore) indexKeys(t Timeout) []string {
+	return []string{
+		r.keys.index + "guild:" + t.GuildId,
+		r.keys.index + "user:" + t.UserId,
+		r.keys.index + "type:" + t.Type,
+		r.keys.index + "moderator:" + t.ModeratorId,
+	}
+}
+
+// stored returns the raw stored timeout with the given id and its index keys, or an
+// empty string if there isn't one. Timeouts that can't be decoded have no index keys.
+func (r *RedisStore) stored(id string) (string, []string, error) {
+	raw, err := r.client.HGet(context.TODO(), r.keys.timeouts, id).Result()
+	if err == redis.Nil {
+		return "", nil, nil
+	}
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	var t Timeout
+	if err := json.Unmarshal([]byte(raw), &t); err != nil {
+		logrus.Warnf("Unable to decode stored timeout %s: %v", id, err)
+		return raw, nil, nil
+	}
+
+	return raw, r.indexKeys(t), nil
+}
+
+func newRedisStore() *RedisStore {
+	return &RedisStore{
+		client: Redis.Connection,
+		keys:   Redis.Keys,
+	}
+}
+
+func (r *RedisStore) Store(t Timeout) (Timeout, bool, error) {
+	for i := 0; i < 10; i++ {
+		bytes, err := json.Marshal(&t)
+		if err != nil {
+			return t, false, err
+		}
+
+		old, oldKeys, err := r.stored(t.Id)
+		if err != nil {
+			return t, false, err
+		}
+
+		keys := append([]string{r.keys.schedule, r.keys.timeouts}, r.indexKeys(t)...)
+		result, err := storeScript.Run(
+			context.TODO(),
+			r.client,
+			append(keys, oldKeys...),
+			t.Id, string(bytes), t.ExpiresAt, old,
+		).Slice()
+
+		if err != nil {
+			return t, false, err
+		}
+
+		id, _ := result[0].(string)
+		replaced, _ := result[1].(int64)
+		if id == t.Id && replaced == changedLua {
+			// It changed since we read it, read it again
+			continue
+		}
+
+		if id == t.Id {
+			return t, replaced == 1, nil
+		}
+
+		// Replace the existing timeout of the same type
+		t.Id = id
+	}
+
+	return t, false, fmt.Errorf("unable to store timeout %s, it kept being replaced", t.Id)
+}
+
+func (r *RedisStore) Get(id string) (*Timeout, error) {
+	raw, err := r.client.HGet(context.TODO(), r.keys.timeouts, id).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var t Timeout
+	if err := json.Unmarshal([]byte(raw), &t); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// indexes returns the index sets of every filter of the query that was given.
+func (r *RedisStore) indexes(q QueryRequest) []string {
+	var indexes []string
+	if q.GuildId != "" {
+		indexes = append(indexes, r.keys.index+"guild:"+q.GuildId)
+	}
+
+	if q.UserId != "" {
+		indexes = append(indexes, r.keys.index+"user:"+q.UserId)
+	}
+
+	if q.Type != "" {
+		indexes = append(indexes, r.keys.index+"type:"+q.Type)
+	}
+
+	if q.ModeratorId != "" {
+		indexes = append(indexes, r.keys.index+"moderator:"+q.ModeratorId)
+	}
+
+	return indexes
+}
+
+func (r *RedisStore) Find(q QueryRequest) ([]Timeout, error) {
+	indexes := r.indexes(q)
+	var keys []string
+	var err error
+	if len(indexes) == 0 {
+		keys, err = r.client.HKeys(context.TODO(), r.keys.timeouts).Result()
+	} else {
+		keys, err = r.client.SInter(context.TODO(), indexes...).Result()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return []Timeout{}, nil
+	}
+
+	return r.getAll(keys)
+}
+
+// getAll returns the timeouts with the given keys in the same order, skipping the ones
+// that are missing.
+func (r *RedisStore) getAll(keys []string) ([]Timeout, error) {
+	timeouts := []Timeout{}
+	data, err := r.client.HMGet(context.TODO(), r.keys.timeouts, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, value := range data {
+		raw, ok := value.(string)
+		if !ok {
+			logrus.Debugf("Index entry %s points to a missing timeout, skipping", keys[i])
+			continue
+		}
+
+		var t Timeout
+		if err := json.Unmarshal([]byte(raw), &t); err != nil {
+			logrus.Warnf("Unable to decode packet %s, skipping", raw)
+			continue
+		}
+
+		timeouts = append(timeouts, t)
+	}
+
+	return timeouts, nil
+}
+
+// Page sorts the matching timeouts by their score in the schedule on the Redis side,
+// by intersecting the schedule with the indexes into a temporary key, so only the page
+// is sent over.
+func (r *RedisStore) Page(q QueryRequest) (QueryResponse, error) {
+	indexes := r.indexes(q)
+	page := QueryResponse{Timeouts: []Timeout{}, Offset: q.Offset}
+	source := r.keys.schedule
+	stop := int64(q.Offset + q.Limit - 1)
+
+	var keys []string
+	if len(indexes) == 0 {
+		pipe := r.client.Pipeline()
+		total := pipe.ZCard(context.TODO(), source)
+		ids := pipe.ZRange(context.TODO(), source, int64(q.Offset), stop)
+		if _, err := pipe.Exec(context.TODO()); err != nil {
+			return page, err
+		}
+
+		page.Total = int(total.Val())
+		keys = ids.Val()
+	} else {
+		// Indexes are sets, which count as a score of 0 with these weights
+		temporary := r.keys.query + generateId()
+		weights := make([]float64, len(indexes)+1)
+		weights[0] = 1
+
+		pipe := r.client.TxPipeline()
+		total := pipe.ZInterStore(context.TODO(), temporary, &redis.ZStore{
+			Keys:    append([]string{source}, indexes...),
+			Weights: weights,
+		})
+		ids := pipe.ZRange(context.TODO(), temporary, int64(q.Offset), stop)
+		pipe.Del(context.TODO(), temporary)
+		if _, err := pipe.Exec(context.TODO()); err != nil {
+			return page, err
+		}
+
+		page.Total = int(total.Val())
+		keys = ids.Val()
+	}
+
+	if len(keys) == 0 {
+		return page, nil
+	}
+
+	timeouts, err := r.getAll(keys)
+	if err != nil {
+		return page, err
+	}
+
+	page.Timeouts = timeouts
+	return page, nil
+}
+
+// Scan reads the hash with HSCAN, so Redis isn't blocked by huge hashes.
+func (r *RedisStore) Scan(size int, fn func(timeouts []Timeout) error) error {
+	// HSCAN can return the same field more than once
+	seen := map[string]struct{}{}
+	cursor := uint64(0)
+	for {
+		data, next, err := r.client.HScan(context.TODO(), r.keys.timeouts, cursor, "", int64(size)).Result()
+		if err != nil {
+			return err
+		}
+
+		timeouts := make([]Timeout, 0, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			if _, ok := seen[data[i]]; ok {
+				continue
+			}
+
+			seen[data[i]] = struct{}{}
+
+			var t Timeout
+			if err := json.Unmarshal([]byte(data[i+1]), &t); err != nil {
+				logrus.Warnf("Unable to decode packet %s, skipping", data[i+1])
+				continue
+			}
+
+			timeouts = append(timeouts, t)
+		}
+
+		if err := fn(timeouts); err != nil {
+			return err
+		}
+
+		if next == 0 {
+			return nil
+		}
+
+		cursor = next
+	}
+}
+
+func (r *RedisStore) Count() (int, error) {
+	count, err := r.client.HLen(context.TODO(), r.keys.timeouts).Result()
+	return int(count), err
+}
+
+func (r *RedisStore) Cancel(id string) (bool, error) {
+	for i := 0; i < 10; i++ {
+		data, keys, err := r.stored(id)
+		if err != nil || data == "" {
+			return false, err
+		}
+
+		cancelled, err := cancelScript.Run(
+			context.TODO(),
+			r.client,
+			append([]string{r.keys.schedule, r.keys.timeouts}, keys...),
+			id, data,
+		).Int()
+
+		if err != nil {
+			return false, err
+		}
+
+		if cancelled != changedLua {
+			return cancelled == 1, nil
+		}
+	}
+
+	return false, fmt.Errorf("unable to cancel timeout %s, it kept changing", id)
+}
+
+func (r *RedisStore) Update(id string, change func(t Timeout) (Timeout, error)) (*Timeout, *Timeout, error) {
+	for i := 0; i < 10; i++ {
+		raw, keys, err := r.stored(id)
+		if err != nil || raw == "" {
+			return nil, nil, err
+		}
+
+		var t Timeout
+		if err := json.Unmarshal([]byte(raw), &t); err != nil {
+			return nil, nil, err
+		}
+
+		updated, err := change(t)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		bytes, err := json.Marshal(&updated)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		keys = append([]string{r.keys.schedule, r.keys.timeouts}, keys...)
+		result, err := updateScript.Run(
+			context.TODO(),
+			r.client,
+			append(keys, r.indexKeys(updated)...),
+			id, raw, string(bytes), updated.ExpiresAt,
+		).Int()
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if result == 0 {
+			return nil, nil, nil
+		}
+
+		if result != changedLua {
+			return &t, &updated, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("unable to update timeout %s, it kept changing", id)
+}
+
+func (r *RedisStore) Due(now int64, limit int) ([]string, error) {
+	return r.client.ZRangeByScore(context.TODO(), r.keys.schedule, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now, 10),
+		Count: int64(limit),
+	}).Result()
+}
+
+func (r *RedisStore) Claim(id string, now int64, deliveryId string, deadline int64) (*Timeout, error) {
+	for i := 0; i < 10; i++ {
+		stored, keys, err := r.stored(id)
+		if err != nil {
+			return nil, err
+		}
+
+		if stored != "" && keys == nil {
+			// It'd never decode, so there's no point in delivering it
+			pipe := r.client.TxPipeline()
+			pipe.ZRem(context.TODO(), r.keys.schedule, id)
+			pipe.HDel(context.TODO(), r.keys.timeouts, id)
+			if _, err := pipe.Exec(context.TODO()); err != nil {
+				return nil, err
+			}
+
+			return nil, fmt.Errorf("dropped timeout %s, it can't be decoded", id)
+		}
+
+		result, err := claimScript.Run(
+			context.TODO(),
+			r.client,
+			append([]string{r.keys.schedule, r.keys.timeouts, r.keys.pending, r.keys.deadlines, r.keys.attempts}, keys...),
+			id, now, deliveryId, deadline, stored,
+		).Result()
+
+		if err == redis.Nil {
+			return nil, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		// Otherwise it changed since we read it, read it again
+		if data, ok := result.(string); ok {
+			var t Timeout
+			if err := json.Unmarshal([]byte(data), &t); err != nil {
+				return nil, err
+			}
+
+			return &t, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unable to claim timeout %s, it kept changing", id)
+}
+
+func (r *RedisStore) Unacknowledged(now int64, limit int) ([]Delivery, error) {
+	ids, err := r.client.ZRangeByScore(context.TODO(), r.keys.deadlines, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now, 10),
+		Count: int64(limit),
+	}).Result()
+
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	deliveries, _, err := r.deliveries(ids)
+	return deliveries, err
+}
+
+// deliveries returns the pending deliveries with the given ids in order, and the ids of
+// the ones that were acknowledged in the meantime.
+func (r *RedisStore) deliveries(ids []string) ([]Delivery, []string, error) {
+	pending, err := r.client.HMGet(context.TODO(), r.keys.pending, ids...).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	attempts, err := r.client.HMGet(context.TODO(), r.keys.attempts, ids...).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var acked []string
+	deliveries := make([]Delivery, 0, len(ids))
+	for i, id := range ids {
+		raw, ok := pending[i].(string)
+		if !ok {
+			acked = append(acked, id)
+			continue
+		}
+
+		var t Timeout
+		if err := json.Unmarshal([]byte(raw), &t); err != nil {
+			logrus.Warnf("Unable to decode delivery %s, skipping", id)
+			continue
+		}
+
+		attempt := 1
+		if value, ok := attempts[i].(string); ok {
+			attempt, _ = strconv.Atoi(value)
+		}
+
+		deliveries = append(deliveries, Delivery{
+			Timeout:    t,
+			DeliveryId: id,
+			Attempt:    attempt,
+		})
+	}
+
+	return deliveries, acked, nil
+}
+
+func (r *RedisStore) Redeliver(deliveryId string, now int64, backoff time.Duration, maxBackoff time.Duration) (*Delivery, error) {
+	result, err := redeliverScript.Run(
+		context.TODO(),
+		r.client,
+		[]string{r.keys.deadlines, r.keys.pending, r.keys.attempts},
+		deliveryId, now, backoff.Milliseconds(), maxBackoff.Milliseconds(),
+	).Slice()
+
+	if err == redis.Nil {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var t Timeout
+	if err := json.Unmarshal([]byte(result[0].(string)), &t); err != nil {
+		_, _ = r.Ack(deliveryId)
+		return nil, err
+	}
+
+	return &Delivery{
+		Timeout:    t,
+		DeliveryId: deliveryId,
+		Attempt:    int(result[1].(int64)),
+	}, nil
+}
+
+func (r *RedisStore) Ack(deliveryId string) (bool, error) {
+	var removed *redis.IntCmd
+	_, err := r.client.TxPipelined(context.TODO(), func(pipe redis.Pipeliner) error {
+		removed = pipe.HDel(context.TODO(), r.keys.pending, deliveryId)
+		pipe.HDel(context.TODO(), r.keys.attempts, deliveryId)
+		pipe.ZRem(context.TODO(), r.keys.deadlines, deliveryId)
+		pipe.LRem(context.TODO(), r.keys.queue, 0, deliveryId)
+		return nil
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	return removed.Val() == 1, nil
+}
+
+func (r *RedisStore) Enqueue(deliveryId string) error {
+	_, err := r.client.TxPipelined(context.TODO(), func(pipe redis.Pipeliner) error {
+		pipe.LRem(context.TODO(), r.keys.queue, 0, deliveryId)
+		pipe.RPush(context.TODO(), r.keys.queue, deliveryId)
+		pipe.ZAddXX(context.TODO(), r.keys.deadlines, &redis.Z{Score: math.Inf(1), Member: deliveryId})
+		return nil
+	})
+
+	return err
+}
+
+func (r *RedisStore) Queued() ([]Delivery, error) {
+	ids, err := r.client.LRange(context.TODO(), r.keys.queue, 0, -1).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	deliveries, acked, err := r.deliveries(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range acked {
+		_ = r.client.LRem(context.TODO(), r.keys.queue, 0, id).Err()
+	}
+
+	return deliveries, nil
+}
+
+func (r *RedisStore) Dequeue(deliveryId string, deadline int64) (bool, error) {
+	removed, err := dequeueScript.Run(
+		context.TODO(),
+		r.client,
+		[]string{r.keys.queue, r.keys.deadlines},
+		deliveryId, deadline,
+	).Int()
+
+	return removed == 1, err
+}
+
+func (r *RedisStore) QueueLength() (int, error) {
+	length, err := r.client.LLen(context.TODO(), r.keys.queue).Result()
+	return int(length), err
+}
+
+// Rehydrate re-adds every stored timeout to the schedule and the indexes, reading them in
+// batches. Timeouts stored by older versions are moved over to the current layout by the
+// migrations.
+func (r *RedisStore) Rehydrate(now int64) (int, []string, error) {
+	if err := rehydrateScript.Load(context.TODO(), r.client).Err(); err != nil {
+		return 0, nil, err
+	}
+
+	total := 0
+	var late []string
+	var cursor uint64
+	for {
+		data, next, err := r.client.HScan(context.TODO(), r.keys.timeouts, cursor, "", 500).Result()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		var ids []string
+		var timeouts []Timeout
+		var commands []*redis.Cmd
+		pipe := r.client.Pipeline()
+		for i := 0; i+1 < len(data); i += 2 {
+			var t Timeout
+			if err := json.Unmarshal([]byte(data[i+1]), &t); err != nil {
+				logrus.Warnf("Unable to decode stored timeout %s, skipping", data[i])
+				continue
+			}
+
+			keys := append([]string{r.keys.schedule, r.keys.timeouts}, r.indexKeys(t)...)
+			ids = append(ids, data[i])
+			timeouts = append(timeouts, t)
+			commands = append(commands, rehydrateScript.EvalSha(context.TODO(), pipe, keys, data[i], data[i+1], t.ExpiresAt))
+		}
+
+		if len(commands) > 0 {
+			if _, err := pipe.Exec(context.TODO()); err != nil {
+				return 0, nil, err
+			}
+		}
+
+		for i, command := range commands {
+			// It was claimed, cancelled or changed since it was read
+			if rehydrated, _ := command.Int(); rehydrated == 0 {
+				continue
+			}
+
+			total++
+			if timeouts[i].ExpiresAt <= now {
+				late = append(late, ids[i])
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+
+	return total, late, nil
+}
+
+func (r *RedisStore) Ping() error {
+	return r.client.Ping(context.TODO()).Err()
+}
+
+func (r *RedisStore) Close() error {
+	return r.client.Close()
+}
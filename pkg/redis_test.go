@@ -0,0 +1,137 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRedisOptionsDB(t *testing.T) {
+	tests := []struct {
+		url  string
+		db   string
+		want int
+	}{
+		{"", "", 0},
+		{"", "3", 3},
+		{"redis://localhost:6379", "3", 3},
+		{"redis://localhost:6379/", "3", 3},
+		{"redis://localhost:6379/0", "3", 0},
+		{"redis://localhost:6379/5", "3", 5},
+		{"redis://localhost:6379/5", "", 5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url+"+"+test.db, func(t *testing.T) {
+			t.Setenv("REDIS_URL", test.url)
+			t.Setenv("REDIS_DB", test.db)
+
+			options, err := redisOptions()
+			if err != nil {
+				t.Fatalf("redisOptions() error = %v", err)
+			}
+
+			if options.DB != test.want {
+				t.Errorf("redisOptions() with REDIS_URL=%q and REDIS_DB=%q uses database %d, want %d", test.url, test.db, options.DB, test.want)
+			}
+		})
+	}
+}
+
+func TestRedisTLSClientCertificate(t *testing.T) {
+	tests := []struct {
+		name string
+		cert string
+		key  string
+	}{
+		{"cert", "client.pem", ""},
+		{"key", "", "client-key.pem"},
+		{"both", "client.pem", "client-key.pem"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("REDIS_TLS", "")
+			t.Setenv("REDIS_TLS_CA_FILE", "")
+			t.Setenv("REDIS_TLS_CERT_FILE", "")
+			t.Setenv("REDIS_TLS_KEY_FILE", "")
+			if test.cert != "" {
+				t.Setenv("REDIS_TLS_CERT_FILE", dir+"/"+test.cert)
+			}
+
+			if test.key != "" {
+				t.Setenv("REDIS_TLS_KEY_FILE", dir+"/"+test.key)
+			}
+
+			// None of the files exist, so the pair must fail to load instead of TLS being skipped
+			_, err := redisTLS(nil)
+			if err == nil || !strings.Contains(err.Error(), "unable to load the Redis client certificate") {
+				t.Errorf("redisTLS() error = %v, want the client certificate to fail to load", err)
+			}
+		})
+	}
+}
+
+// hashSlot returns the Redis Cluster hash slot of the key, which is the CRC16 of its hash
+// tag if it has one, or of the whole key otherwise.
+func hashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	crc := uint16(0)
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return int(crc) % 16384
+}
+
+func TestRedisKeysHashSlot(t *testing.T) {
+	// Known slots, from `CLUSTER KEYSLOT`
+	for key, want := range map[string]int{"foo": 12182, "bar": 5061, "{user1000}.following": 3443} {
+		if got := hashSlot(key); got != want {
+			t.Fatalf("hashSlot(%q) = %d, want %d", key, got, want)
+		}
+	}
+
+	keys := reflect.ValueOf(newRedisKeys("nino:timeouts", true))
+	want := hashSlot(keys.Field(0).String())
+	for i := 0; i < keys.NumField(); i++ {
+		// Prefixes of keys get a suffix, like the guild of an index
+		key := keys.Field(i).String() + testGuildId
+		if got := hashSlot(key); got != want {
+			t.Errorf("%s key %q is in slot %d, want %d like the others", keys.Type().Field(i).Name, key, got, want)
+		}
+	}
+}
@@ -0,0 +1,436 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQueryLimit = 50
+	maxQueryLimit     = 500
+)
+
+var Scheduler *TimeoutScheduler
+
+// TimeoutScheduler polls the store for due timeouts and applies them, so timeouts
+// survive restarts.
+type TimeoutScheduler struct {
+	interval    time.Duration
+	batch       int
+	ackDeadline time.Duration
+	maxBackoff  time.Duration
+	chunkSize   int
+	stop        chan struct{}
+	wg          *sync.WaitGroup
+}
+
+func NewScheduler() {
+	if Scheduler != nil {
+		panic("Attempt to initialise another scheduler instance!")
+	}
+
+	Scheduler = &TimeoutScheduler{
+		interval:    envPositiveDuration("SCHEDULER_POLL_INTERVAL", time.Second),
+		batch:       envPositiveInt("SCHEDULER_BATCH_SIZE", 100),
+		ackDeadline: envPositiveDuration("APPLY_ACK_DEADLINE", 30*time.Second),
+		maxBackoff:  envPositiveDuration("APPLY_MAX_BACKOFF", 10*time.Minute),
+		chunkSize:   envPositiveInt("REQUEST_ALL_CHUNK_SIZE", 1000),
+		stop:        make(chan struct{}),
+		wg:          &sync.WaitGroup{},
+	}
+}
+
+func generateId() string {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(bytes)
+}
+
+// Schedule stores the timeout and arms it to be applied at `ExpiresAt`. A user can have
+// one timeout of each type per guild, so an existing timeout of the same type is replaced
+// and keeps its id. It returns the stored timeout with its id.
+func (s *TimeoutScheduler) Schedule(t Timeout) (Timeout, error) {
+	if t.Id == "" {
+		t.Id = generateId()
+	}
+
+	stored, replaced, err := Store.Store(t)
+	if err != nil {
+		return stored, err
+	}
+
+	if !replaced && MetricsEnabled {
+		TimeoutMetric.Inc()
+	}
+
+	return stored, nil
+}
+
+// find returns the ids of the pending timeouts for the user in the guild, optionally
+// only of the given type.
+func (s *TimeoutScheduler) find(guildId string, userId string, kind string) ([]string, error) {
+	timeouts, err := Store.Find(QueryRequest{GuildId: guildId, UserId: userId, Type: kind})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(timeouts))
+	for _, t := range timeouts {
+		ids = append(ids, t.Id)
+	}
+
+	return ids, nil
+}
+
+// Get returns the pending timeout with the given id, or `nil` if there isn't one.
+func (s *TimeoutScheduler) Get(id string) (*Timeout, error) {
+	return Store.Get(id)
+}
+
+// Scan calls `send` with every pending timeout, in chunks of `REQUEST_ALL_CHUNK_SIZE`.
+// The store is read in batches, but timeouts that are added or removed in the meantime
+// may or may not be included.
+//
+// The chunk count is estimated from the amount of timeouts when the scan started, until
+// the last chunk, which always has `chunk_index == chunk_count - 1`.
+func (s *TimeoutScheduler) Scan(send func(chunk TimeoutChunk) error) error {
+	total, err := Store.Count()
+	if err != nil {
+		return err
+	}
+
+	size := s.chunkSize
+	estimate := (total + size - 1) / size
+	index := 0
+	emit := func(timeouts []Timeout, last bool) error {
+		count := estimate
+		if last {
+			count = index + 1
+		} else if count < index+2 {
+			count = index + 2
+		}
+
+		chunk := TimeoutChunk{
+			Timeouts:   timeouts,
+			ChunkIndex: index,
+			ChunkCount: count,
+			Total:      total,
+		}
+
+		index++
+		return send(chunk)
+	}
+
+	// Full chunks are sent right away, except the last one which has to be marked as such,
+	// so a full chunk is only sent once we know more timeouts follow it.
+	buffer := []Timeout{}
+	err = Store.Scan(size, func(timeouts []Timeout) error {
+		for _, t := range timeouts {
+			if len(buffer) == size {
+				if err := emit(buffer, false); err != nil {
+					return err
+				}
+
+				buffer = make([]Timeout, 0, size)
+			}
+
+			buffer = append(buffer, t)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return emit(buffer, true)
+}
+
+// Query returns a page of pending timeouts matching every filter that was given,
+// ordered by when they expire. Only the page is read from the store.
+func (s *TimeoutScheduler) Query(q QueryRequest) (QueryResponse, error) {
+	if q.Limit <= 0 || q.Limit > maxQueryLimit {
+		q.Limit = defaultQueryLimit
+	}
+
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+
+	return Store.Page(q)
+}
+
+// Cancel removes the pending timeout with the given id so it never gets applied,
+// and reports whether there was anything to cancel.
+func (s *TimeoutScheduler) Cancel(id string) (bool, error) {
+	cancelled, err := Store.Cancel(id)
+	if err != nil {
+		return false, err
+	}
+
+	if cancelled && MetricsEnabled {
+		TimeoutMetric.Dec()
+	}
+
+	return cancelled, nil
+}
+
+// CancelFor cancels the pending timeouts for the user in the guild, and reports whether
+// there was anything to cancel. An empty type cancels every type of timeout.
+func (s *TimeoutScheduler) CancelFor(guildId string, userId string, kind string) (bool, error) {
+	ids, err := s.find(guildId, userId, kind)
+	if store, ok := Store.(*BufferedStore); ok && errors.Is(err, ErrStoreUnavailable) {
+		// The store is degraded, so the whole cancellation is buffered instead
+		buffering, bufferErr := store.CancelFor(guildId, userId, kind)
+		if bufferErr != nil {
+			return false, bufferErr
+		}
+
+		if buffering {
+			return false, ErrWriteBuffered
+		}
+
+		// The store came back in the meantime
+		ids, err = s.find(guildId, userId, kind)
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	// Buffered cancellations are still applied, so the others are cancelled as well
+	found := false
+	var buffered error
+	for _, id := range ids {
+		cancelled, err := s.Cancel(id)
+		if errors.Is(err, ErrWriteBuffered) {
+			buffered = err
+			continue
+		}
+
+		if err != nil {
+			return found, err
+		}
+
+		found = found || cancelled
+	}
+
+	if buffered != nil {
+		return found, buffered
+	}
+
+	return found, nil
+}
+
+// Update changes the expiry (and optionally the reason) of a pending timeout and
+// re-schedules it. The timeout is looked up by id, or by the guild, user and type if
+// no id is given, which fails with `INVALID_FIELD` if that matches more than one. It
+// returns the timeout before and after the update, or `nil`s if there was no such
+// pending timeout.
+func (s *TimeoutScheduler) Update(req UpdateRequest) (*Timeout, *Timeout, error) {
+	key := req.Id
+	if key == "" {
+		ids, err := s.find(req.GuildId, req.UserId, req.Type)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(ids) == 0 {
+			return nil, nil, nil
+		}
+
+		// Without a type, it's ambiguous which timeout to update if there are many
+		if len(ids) > 1 {
+			return nil, nil, newError(ErrorInvalidField, "type", fmt.Sprintf("The user has %d pending timeouts, `type` or `id` is needed to pick one", len(ids)))
+		}
+
+		key = ids[0]
+	}
+
+	return Store.Update(key, func(t Timeout) (Timeout, error) {
+		if req.ExpiresAt <= t.IssuedAt {
+			return t, newError(ErrorInvalidField, "expires_at", "`expires_at` must be after `issued_at`")
+		}
+
+		t.ExpiresAt = req.ExpiresAt
+		if req.Reason != nil {
+			t.Reason = *req.Reason
+		}
+
+		return t, nil
+	})
+}
+
+// Start begins polling for due timeouts in the background.
+func (s *TimeoutScheduler) Start() {
+	logrus.Infof("Polling for due timeouts every %s", s.interval)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+
+			case <-ticker.C:
+				s.poll()
+			}
+		}
+	}()
+}
+
+// Stop stops polling and waits for the current poll to finish.
+func (s *TimeoutScheduler) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+func (s *TimeoutScheduler) poll() {
+	now := time.Now().UnixMilli()
+	keys, err := Store.Due(now, s.batch)
+	if errors.Is(err, ErrStoreUnavailable) {
+		// Already logged when the store became unavailable, they'll be applied once it's back
+		return
+	}
+
+	if err != nil {
+		logrus.Errorf("Unable to poll for due timeouts: %v", err)
+		return
+	}
+
+	for _, key := range keys {
+		s.fire(key, now)
+	}
+
+	s.redeliver(now)
+	Server.ReplayQueued()
+}
+
+func (s *TimeoutScheduler) fire(key string, now int64) {
+	id := generateId()
+	t, err := Store.Claim(key, now, id, now+s.ackDeadline.Milliseconds())
+	if err != nil {
+		logrus.Errorf("Unable to claim timeout %s: %v", key, err)
+		return
+	}
+
+	if t == nil {
+		// Someone else got to it first, or it was moved into the future.
+		return
+	}
+
+	if MetricsEnabled {
+		TimeoutMetric.Dec()
+	}
+
+	Server.Dispatch(Delivery{
+		Timeout:    *t,
+		DeliveryId: id,
+		Attempt:    1,
+	})
+}
+
+// redeliver resends the deliveries that weren't acknowledged in time. Deliveries whose
+// shard isn't connected to us are queued instead, so we don't burn through their backoff
+// while the bot is away, and they're sent once the shard connects.
+func (s *TimeoutScheduler) redeliver(now int64) {
+	deliveries, err := Store.Unacknowledged(now, s.batch)
+	if err != nil {
+		logrus.Errorf("Unable to poll for unacknowledged deliveries: %v", err)
+		return
+	}
+
+	for _, pending := range deliveries {
+		if Server.ClientFor(pending.GuildId) == nil {
+			logrus.Debugf("Delivery %s wasn't acknowledged, but its shard is disconnected, queueing it", pending.DeliveryId)
+			Server.QueueIn(pending)
+
+			continue
+		}
+
+		id := pending.DeliveryId
+		delivery, err := Store.Redeliver(id, now, s.ackDeadline, s.maxBackoff)
+		if err != nil {
+			logrus.Errorf("Unable to claim delivery %s for redelivery: %v", id, err)
+			continue
+		}
+
+		if delivery == nil {
+			continue
+		}
+
+		logrus.Warnf("Delivery %s wasn't acknowledged, redelivering (attempt %d)", id, delivery.Attempt)
+		if MetricsEnabled {
+			RedeliveryMetric.Inc()
+		}
+
+		Server.Dispatch(*delivery)
+	}
+}
+
+// Ack marks a delivery as processed by the bot, so it won't be redelivered again.
+func (s *TimeoutScheduler) Ack(id string) (bool, error) {
+	return Store.Ack(id)
+}
+
+// Rehydrate re-arms every stored timeout, and immediately fires the ones that
+// expired while the service was down.
+func (s *TimeoutScheduler) Rehydrate() error {
+	now := time.Now().UnixMilli()
+	total, late, err := Store.Rehydrate(now)
+	if err != nil {
+		return err
+	}
+
+	recovered := total - len(late)
+	logrus.Infof("Recovered %d pending timeouts, %d expired while we were down and will be fired late", recovered, len(late))
+	if queued, err := Store.QueueLength(); err == nil && queued > 0 {
+		logrus.Infof("%d events are still queued, they'll be replayed once their shards connect", queued)
+	}
+
+	if MetricsEnabled {
+		TimeoutMetric.Set(float64(total))
+		RecoveredTimeoutsMetric.WithLabelValues("scheduled").Add(float64(recovered))
+		RecoveredTimeoutsMetric.WithLabelValues("late").Add(float64(len(late)))
+	}
+
+	for _, key := range late {
+		s.fire(key, now)
+	}
+
+	return nil
+}
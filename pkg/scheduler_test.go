@@ -0,0 +1,181 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestSchedulerScanChunks(t *testing.T) {
+	tests := []struct {
+		name      string
+		timeouts  int
+		chunkSize int
+		want      []int
+	}{
+		{"empty", 0, 2, []int{0}},
+		{"single chunk", 3, 5, []int{3}},
+		{"exact multiple", 4, 2, []int{2, 2}},
+		{"partial last chunk", 5, 2, []int{2, 2, 1}},
+		{"chunk of one", 3, 1, []int{1, 1, 1}},
+	}
+
+	defer func(store TimeoutStore) {
+		Store = store
+	}(Store)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			Store = newMemoryStore()
+			for i := 0; i < test.timeouts; i++ {
+				id := strconv.Itoa(i)
+				if _, _, err := Store.Store(testTimeout(id, "1", id, "mute", 100)); err != nil {
+					t.Fatalf("Store() error = %v", err)
+				}
+			}
+
+			scheduler := &TimeoutScheduler{chunkSize: test.chunkSize}
+			var chunks []TimeoutChunk
+			err := scheduler.Scan(func(chunk TimeoutChunk) error {
+				chunks = append(chunks, chunk)
+				return nil
+			})
+
+			if err != nil {
+				t.Fatalf("Scan() error = %v", err)
+			}
+
+			if len(chunks) != len(test.want) {
+				t.Fatalf("Scan() sent %d chunks, want %d", len(chunks), len(test.want))
+			}
+
+			seen := map[string]bool{}
+			for i, chunk := range chunks {
+				if chunk.ChunkIndex != i || chunk.ChunkCount != len(test.want) || chunk.Total != test.timeouts {
+					t.Errorf("chunk %d = index %d of %d (total %d), want index %d of %d (total %d)",
+						i, chunk.ChunkIndex, chunk.ChunkCount, chunk.Total, i, len(test.want), test.timeouts)
+				}
+
+				if len(chunk.Timeouts) != test.want[i] {
+					t.Errorf("chunk %d has %d timeouts, want %d", i, len(chunk.Timeouts), test.want[i])
+				}
+
+				for _, timeout := range chunk.Timeouts {
+					if seen[timeout.Id] {
+						t.Errorf("timeout %s was sent twice", timeout.Id)
+					}
+
+					seen[timeout.Id] = true
+				}
+			}
+
+			if last := chunks[len(chunks)-1]; last.ChunkIndex != last.ChunkCount-1 {
+				t.Errorf("last chunk has index %d of %d", last.ChunkIndex, last.ChunkCount)
+			}
+		})
+	}
+}
+
+func TestSchedulerScanStops(t *testing.T) {
+	defer func(store TimeoutStore) {
+		Store = store
+	}(Store)
+
+	Store = newMemoryStore()
+	for i := 0; i < 10; i++ {
+		id := strconv.Itoa(i)
+		if _, _, err := Store.Store(testTimeout(id, "1", id, "mute", 100)); err != nil {
+			t.Fatalf("Store() error = %v", err)
+		}
+	}
+
+	// As if the connection died after the first chunk
+	closed := errors.New("connection closed")
+	sent := 0
+	err := (&TimeoutScheduler{chunkSize: 2}).Scan(func(chunk TimeoutChunk) error {
+		sent++
+		return closed
+	})
+
+	if !errors.Is(err, closed) || sent != 1 {
+		t.Errorf("Scan() = %v after %d chunks, want it to stop after the failed one", err, sent)
+	}
+}
+
+func TestSchedulerUpdateLookup(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     UpdateRequest
+		updated string
+		field   string
+	}{
+		{"by id", UpdateRequest{Id: "ban"}, "ban", ""},
+		{"by type", UpdateRequest{GuildId: "1", UserId: "2", Type: "mute"}, "mute", ""},
+		{"only one pending", UpdateRequest{GuildId: "1", UserId: "3"}, "other", ""},
+		{"nothing pending", UpdateRequest{GuildId: "1", UserId: "4"}, "", ""},
+		{"ambiguous", UpdateRequest{GuildId: "1", UserId: "2"}, "", "type"},
+	}
+
+	defer func(store TimeoutStore) {
+		Store = store
+	}(Store)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			Store = newMemoryStore()
+			for _, timeout := range []Timeout{
+				testTimeout("mute", "1", "2", "mute", 100),
+				testTimeout("ban", "1", "2", "ban", 100),
+				testTimeout("other", "1", "3", "ban", 100),
+			} {
+				if _, _, err := Store.Store(timeout); err != nil {
+					t.Fatalf("Store() error = %v", err)
+				}
+			}
+
+			test.req.ExpiresAt = 200
+			_, after, err := (&TimeoutScheduler{}).Update(test.req)
+
+			var response ErrorResponse
+			if test.field != "" {
+				if !errors.As(err, &response) || response.Code != ErrorInvalidField || response.Field != test.field {
+					t.Errorf("Update() error = %v, want INVALID_FIELD on %s", err, test.field)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Update() error = %v", err)
+			}
+
+			if test.updated == "" && after != nil {
+				t.Errorf("Update() = %+v, want nothing updated", after)
+			}
+
+			if test.updated != "" && (after == nil || after.Id != test.updated || after.ExpiresAt != 200) {
+				t.Errorf("Update() = %+v, want %s to expire at 200", after, test.updated)
+			}
+		})
+	}
+}
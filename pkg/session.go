@@ -0,0 +1,193 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errSessionDetached = errors.New("no client is attached to the session")
+
+// Session keeps the last events sent to a shard, so it can resume after reconnecting
+// and receive exactly the events it missed. Only the token that created it can resume it.
+type Session struct {
+	Id           string
+	Token        string
+	ShardId      int
+	ShardCount   int
+	Name         string
+	Version      string
+	Capabilities []string
+
+	mutex          *sync.Mutex
+	seq            int64
+	buffer         []Message
+	size           int
+	client         *Client
+	disconnectedAt time.Time
+
+	// writing makes sure events are written in order, without holding the mutex while
+	// waiting on the network. outbox has the events the client didn't receive yet, and
+	// delivered is the last one that made it.
+	writing   *sync.Mutex
+	outbox    []Message
+	delivered int64
+}
+
+func newSession(client *Client, size int) *Session {
+	return &Session{
+		Id:           generateId(),
+		Token:        client.Token.Name,
+		ShardId:      client.ShardId,
+		ShardCount:   client.ShardCount,
+		Name:         client.Name,
+		Version:      client.Version,
+		Capabilities: client.Capabilities,
+		mutex:        &sync.Mutex{},
+		buffer:       []Message{},
+		size:         size,
+		client:       client,
+		writing:      &sync.Mutex{},
+	}
+}
+
+// Send assigns the next sequence number to the event, buffers it and writes it to
+// the session's current client. It returns an error if there is no client or the
+// write failed, the event is still buffered for when the session is resumed.
+func (s *Session) Send(msg Message) error {
+	s.mutex.Lock()
+	s.seq++
+	msg.Seq = s.seq
+	s.buffer = append(s.buffer, msg)
+	if len(s.buffer) > s.size {
+		s.buffer = s.buffer[len(s.buffer)-s.size:]
+	}
+
+	client := s.client
+	if client != nil {
+		s.outbox = append(s.outbox, msg)
+	}
+
+	s.mutex.Unlock()
+
+	if client == nil {
+		return errSessionDetached
+	}
+
+	if err := s.flush(client); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Another call may have written it, or failed to
+	if s.client != client || s.delivered < msg.Seq {
+		return errSessionDetached
+	}
+
+	return nil
+}
+
+// flush writes the events in the outbox in order. Only one call writes at a time, and
+// writes the events of concurrent calls as well. If a write fails, the connection is
+// closed, and the rest are only sent if the session is resumed.
+func (s *Session) flush(client *Client) error {
+	s.writing.Lock()
+	defer s.writing.Unlock()
+
+	for {
+		s.mutex.Lock()
+		if s.client != client {
+			s.mutex.Unlock()
+			return errSessionDetached
+		}
+
+		pending := s.outbox
+		s.outbox = nil
+		s.mutex.Unlock()
+
+		if len(pending) == 0 {
+			return nil
+		}
+
+		for _, msg := range pending {
+			if err := client.WriteMessage(msg); err != nil {
+				return err
+			}
+
+			s.mutex.Lock()
+			if s.client == client {
+				s.delivered = msg.Seq
+			}
+
+			s.mutex.Unlock()
+		}
+	}
+}
+
+// Resume attaches the client to the session and replays every event after the given
+// sequence. It returns false if some of those events aren't buffered anymore.
+func (s *Session) Resume(client *Client, lastSeq int64) (int, bool) {
+	s.mutex.Lock()
+	oldest := s.seq - int64(len(s.buffer))
+	if lastSeq < oldest || lastSeq > s.seq {
+		s.mutex.Unlock()
+		return 0, false
+	}
+
+	s.client = client
+	s.disconnectedAt = time.Time{}
+	s.delivered = lastSeq
+	s.outbox = nil
+	for _, msg := range s.buffer {
+		if msg.Seq > lastSeq {
+			s.outbox = append(s.outbox, msg)
+		}
+	}
+
+	replayed := len(s.outbox)
+	s.mutex.Unlock()
+
+	_ = s.flush(client)
+	return replayed, true
+}
+
+// detach marks the session as disconnected if the client is still attached to it.
+func (s *Session) detach(client *Client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.client == client {
+		s.client = nil
+		s.outbox = nil
+		s.disconnectedAt = time.Now()
+	}
+}
+
+func (s *Session) expired(timeout time.Duration) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.client == nil && time.Since(s.disconnectedAt) > timeout
+}
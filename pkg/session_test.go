@@ -0,0 +1,589 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestClient connects a client over a real WebSocket, and returns it along with the
+// other end of the connection to read what it is sent.
+func newTestClient(t *testing.T) (*Client, *websocket.Conn) {
+	previous := Server
+	Server = &WebSocketServer{heartbeatTimeout: time.Second}
+	t.Cleanup(func() {
+		Server = previous
+	})
+
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, req, nil)
+		if err != nil {
+			t.Errorf("Unable to upgrade: %v", err)
+			return
+		}
+
+		conns <- conn
+	}))
+
+	t.Cleanup(server.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Unable to connect: %v", err)
+	}
+
+	conn := <-conns
+	t.Cleanup(func() {
+		_ = peer.Close()
+		_ = conn.Close()
+	})
+
+	return &Client{
+		Conn:      conn,
+		Token:     &Token{Name: "bot"},
+		encoding:  &Encoding{Name: EncodingJSON, marshal: json.Marshal, unmarshal: json.Unmarshal},
+		writeLock: &sync.Mutex{},
+		stateLock: &sync.Mutex{},
+	}, peer
+}
+
+// readSeqs reads `count` events from the connection and returns their sequence numbers.
+func readSeqs(t *testing.T, peer *websocket.Conn, count int) []int64 {
+	seqs := []int64{}
+	for i := 0; i < count; i++ {
+		_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+
+		var msg Message
+		if err := peer.ReadJSON(&msg); err != nil {
+			t.Fatalf("Unable to read event %d: %v", i, err)
+		}
+
+		seqs = append(seqs, msg.Seq)
+	}
+
+	return seqs
+}
+
+func TestSessionResume(t *testing.T) {
+	tests := []struct {
+		name    string
+		lastSeq int64
+		ok      bool
+		want    []int64
+	}{
+		{"before the buffer", 1, false, nil},
+		{"oldest buffered", 2, true, []int64{3, 4, 5}},
+		{"partially caught up", 4, true, []int64{5}},
+		{"caught up", 5, true, []int64{}},
+		{"ahead of the session", 6, false, nil},
+		{"negative", -1, false, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			first, _ := newTestClient(t)
+			session := newSession(first, 3)
+			session.detach(first)
+
+			// Sent while disconnected, only the last 3 are kept
+			for i := 0; i < 5; i++ {
+				if err := session.Send(Message{OP: Apply}); !errors.Is(err, errSessionDetached) {
+					t.Fatalf("Send() error = %v, want errSessionDetached", err)
+				}
+			}
+
+			if len(session.buffer) != 3 || session.buffer[0].Seq != 3 {
+				t.Fatalf("buffer = %+v, want the events 3 to 5", session.buffer)
+			}
+
+			client, peer := newTestClient(t)
+			replayed, ok := session.Resume(client, test.lastSeq)
+			if ok != test.ok {
+				t.Fatalf("Resume(%d) = %d, %v, want ok = %v", test.lastSeq, replayed, ok, test.ok)
+			}
+
+			if !ok {
+				if err := session.Send(Message{OP: Apply}); !errors.Is(err, errSessionDetached) {
+					t.Errorf("Send() error = %v after a failed resume, want errSessionDetached", err)
+				}
+
+				return
+			}
+
+			if replayed != len(test.want) {
+				t.Errorf("Resume(%d) replayed %d events, want %d", test.lastSeq, replayed, len(test.want))
+			}
+
+			if seqs := readSeqs(t, peer, len(test.want)); !reflect.DeepEqual(seqs, test.want) {
+				t.Errorf("Resume(%d) sent %v, want %v", test.lastSeq, seqs, test.want)
+			}
+
+			// New events follow the replayed ones
+			if err := session.Send(Message{OP: Apply}); err != nil {
+				t.Fatalf("Send() error = %v", err)
+			}
+
+			if seqs := readSeqs(t, peer, 1); seqs[0] != 6 || session.delivered != 6 {
+				t.Errorf("Send() sent %v and delivered %d, want 6", seqs, session.delivered)
+			}
+		})
+	}
+}
+
+func TestSessionSend(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// setup returns the client events should arrive at, if any
+		setup         func(t *testing.T, session *Session, first *Client) *websocket.Conn
+		wantErr       error
+		wantDelivered int64
+	}{
+		{
+			name:          "attached",
+			setup:         func(t *testing.T, session *Session, first *Client) *websocket.Conn { return nil },
+			wantDelivered: 2,
+		},
+		{
+			name: "detached",
+			setup: func(t *testing.T, session *Session, first *Client) *websocket.Conn {
+				session.detach(first)
+				return nil
+			},
+			wantErr:       errSessionDetached,
+			wantDelivered: 1,
+		},
+		{
+			name: "write failed",
+			setup: func(t *testing.T, session *Session, first *Client) *websocket.Conn {
+				_ = first.Conn.Close()
+				return nil
+			},
+			wantErr:       net.ErrClosed,
+			wantDelivered: 1,
+		},
+		{
+			name: "resumed by another client",
+			setup: func(t *testing.T, session *Session, first *Client) *websocket.Conn {
+				client, peer := newTestClient(t)
+				if _, ok := session.Resume(client, 1); !ok {
+					t.Fatalf("Resume(1) failed")
+				}
+
+				// The old connection going away doesn't detach the new one
+				session.detach(first)
+				return peer
+			},
+			wantDelivered: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			first, firstPeer := newTestClient(t)
+			session := newSession(first, 10)
+			if err := session.Send(Message{OP: Apply}); err != nil {
+				t.Fatalf("Send() error = %v", err)
+			}
+
+			readSeqs(t, firstPeer, 1)
+
+			peer := test.setup(t, session, first)
+			if peer == nil {
+				peer = firstPeer
+			}
+
+			if err := session.Send(Message{OP: Apply}); !errors.Is(err, test.wantErr) {
+				t.Errorf("Send() error = %v, want %v", err, test.wantErr)
+			}
+
+			if session.delivered != test.wantDelivered {
+				t.Errorf("delivered = %d, want %d", session.delivered, test.wantDelivered)
+			}
+
+			if test.wantErr == nil {
+				if seqs := readSeqs(t, peer, 1); seqs[0] != 2 {
+					t.Errorf("Send() sent %v, want 2", seqs)
+				}
+			}
+
+			// Sent or not, the event is kept for resuming
+			if len(session.buffer) != 2 || session.buffer[1].Seq != 2 {
+				t.Errorf("buffer = %+v, want the events 1 and 2", session.buffer)
+			}
+		})
+	}
+}
+
+// noReply is the operation of a test case that expects nothing back.
+const noReply OperationType = -1
+
+// testMessage is a message read by the tests, whose payload is decoded later.
+type testMessage struct {
+	OP   OperationType   `json:"op"`
+	Data json.RawMessage `json:"d"`
+}
+
+// newTestServer serves WebSockets like `main.go` does, with the tokens of `newTestAPI`
+// and the server configured from the environment, and returns its URL.
+func newTestServer(t *testing.T) string {
+	newTestAPI(t, newMemoryStore())
+	Access.connectRate, Access.connectBurst = rate.Inf, 1
+	Access.messageRate, Access.messageBurst = rate.Inf, 1
+
+	previous := Server
+	Server = nil
+	NewServer()
+	t.Cleanup(func() {
+		Server = previous
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(HandleRequest))
+	t.Cleanup(server.Close)
+
+	// Connections are torn down in the background, so wait until they're gone before
+	// the globals are restored
+	t.Cleanup(func() {
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			Access.mutex.Lock()
+			open := len(Access.connections)
+			Access.mutex.Unlock()
+
+			if open == 0 {
+				return
+			}
+		}
+
+		t.Errorf("Connections are still open after the test")
+	})
+
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// dialTestServer connects with the secret in the `Authorization` header, if any, and
+// reads the `Hello`.
+func dialTestServer(t *testing.T, url string, secret string) *websocket.Conn {
+	header := http.Header{}
+	if secret != "" {
+		header.Set("Authorization", secret)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("Unable to connect: %v", err)
+	}
+
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	if msg, err := readMessage(conn); err != nil || msg.OP != Hello {
+		t.Fatalf("First message = %+v, %v, want Hello", msg, err)
+	}
+
+	return conn
+}
+
+func sendMessage(conn *websocket.Conn, op OperationType, data interface{}) error {
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+	return conn.WriteJSON(Message{OP: op, Data: data})
+}
+
+func readMessage(conn *websocket.Conn) (testMessage, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	var msg testMessage
+	err := conn.ReadJSON(&msg)
+	return msg, err
+}
+
+func TestHandshake(t *testing.T) {
+	bot := ClientInfo{Name: "nino", Version: "1.0.0"}
+	tests := []struct {
+		name          string
+		handshakeAuth bool
+		identifyAfter time.Duration
+		header        string
+		op            OperationType
+		data          interface{}
+
+		want             OperationType
+		wantCode         ErrorCode
+		wantClosed       bool
+		wantRegistered   bool
+		wantCapabilities []string
+	}{
+		{
+			name:             "identify",
+			header:           "writer",
+			op:               Identify,
+			data:             IdentifyRequest{Client: bot},
+			want:             Ready,
+			wantRegistered:   true,
+			wantCapabilities: []string{},
+		},
+		{
+			name:             "identify with the connect token",
+			header:           "writer",
+			op:               Identify,
+			data:             IdentifyRequest{Token: "writer", Client: bot},
+			want:             Ready,
+			wantRegistered:   true,
+			wantCapabilities: []string{},
+		},
+		{
+			name:       "identify with another token",
+			header:     "writer",
+			op:         Identify,
+			data:       IdentifyRequest{Token: "admin", Client: bot},
+			want:       Error,
+			wantCode:   ErrorUnauthorized,
+			wantClosed: true,
+		},
+		{
+			name:       "identify with a wrong token",
+			header:     "writer",
+			op:         Identify,
+			data:       IdentifyRequest{Token: "wrong", Client: bot},
+			want:       Error,
+			wantCode:   ErrorUnauthorized,
+			wantClosed: true,
+		},
+		{
+			name:             "read-only token",
+			header:           "reader",
+			op:               Identify,
+			data:             IdentifyRequest{Client: bot},
+			want:             Ready,
+			wantCapabilities: []string{},
+		},
+		{
+			name:             "supported capabilities",
+			header:           "writer",
+			op:               Identify,
+			data:             IdentifyRequest{Client: bot, Capabilities: []string{"zstd", CapabilityAck, "unknown"}},
+			want:             Ready,
+			wantRegistered:   true,
+			wantCapabilities: []string{CapabilityAck},
+		},
+		{
+			name:             "token in the handshake",
+			handshakeAuth:    true,
+			op:               Identify,
+			data:             IdentifyRequest{Token: "writer", Client: bot},
+			want:             Ready,
+			wantRegistered:   true,
+			wantCapabilities: []string{},
+		},
+		{
+			name:          "no token at all",
+			handshakeAuth: true,
+			op:            Identify,
+			data:          IdentifyRequest{Client: bot},
+			want:          Error,
+			wantCode:      ErrorUnauthorized,
+			wantClosed:    true,
+		},
+		{
+			name:     "invalid identify",
+			header:   "writer",
+			op:       Identify,
+			data:     IdentifyRequest{Client: bot, Shard: []int{2, 2}},
+			want:     Error,
+			wantCode: ErrorInvalidField,
+		},
+		{
+			name:       "identify after the timeout",
+			header:     "writer",
+			op:         Identify,
+			data:       IdentifyRequest{Client: bot},
+			want:       noReply,
+			wantClosed: true,
+
+			identifyAfter: 300 * time.Millisecond,
+		},
+		{
+			name:     "request before identifying",
+			header:   "writer",
+			op:       Query,
+			data:     QueryRequest{},
+			want:     Error,
+			wantCode: ErrorUnauthorized,
+		},
+		{
+			name:   "heartbeat before identifying",
+			header: "writer",
+			op:     Heartbeat,
+			want:   HeartbeatAck,
+		},
+		{
+			name:   "resume an unknown session",
+			header: "writer",
+			op:     Resume,
+			data:   ResumeRequest{SessionId: "unknown"},
+			want:   InvalidSession,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("HANDSHAKE_AUTH", strconv.FormatBool(test.handshakeAuth))
+			t.Setenv("IDENTIFY_TIMEOUT", "")
+			if test.identifyAfter > 0 {
+				t.Setenv("IDENTIFY_TIMEOUT", (test.identifyAfter / 3).String())
+			}
+
+			conn := dialTestServer(t, newTestServer(t), test.header)
+			time.Sleep(test.identifyAfter)
+
+			// Sending may already fail if the connection was closed
+			err := sendMessage(conn, test.op, test.data)
+			msg := testMessage{OP: noReply}
+			if err == nil {
+				msg, err = readMessage(conn)
+			}
+
+			if test.want == noReply {
+				if err == nil {
+					t.Fatalf("Received %+v, want nothing", msg)
+				}
+			} else if err != nil || msg.OP != test.want {
+				t.Fatalf("Reply = %+v, %v, want op %d", msg, err, test.want)
+			}
+
+			if test.want == Error {
+				var res ErrorResponse
+				if err := json.Unmarshal(msg.Data, &res); err != nil || res.Code != test.wantCode {
+					t.Errorf("Error = %s, want %s", msg.Data, test.wantCode)
+				}
+			}
+
+			if test.want == Ready {
+				var ready ReadyData
+				if err := json.Unmarshal(msg.Data, &ready); err != nil {
+					t.Fatalf("Unable to decode Ready: %v", err)
+				}
+
+				if !reflect.DeepEqual(ready.Capabilities, test.wantCapabilities) {
+					t.Errorf("Ready capabilities = %v, want %v", ready.Capabilities, test.wantCapabilities)
+				}
+			}
+
+			// Rejected clients are disconnected, the others aren't. Messages are handled in
+			// order during the handshake, so the client was registered by the time the
+			// heartbeat is acknowledged.
+			err = sendMessage(conn, Heartbeat, nil)
+			if err == nil {
+				msg, err = readMessage(conn)
+			}
+
+			if test.wantClosed != (err != nil) {
+				t.Errorf("Heartbeat after the handshake = %+v, %v, want closed = %v", msg, err, test.wantClosed)
+			}
+
+			if registered := Server.ClientFor(testGuildId) != nil; registered != test.wantRegistered {
+				t.Errorf("registered = %v, want %v", registered, test.wantRegistered)
+			}
+		})
+	}
+}
+
+// waitFor polls the condition until it holds or a second passed, and returns if it held.
+func waitFor(condition func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestHeartbeatTimeout(t *testing.T) {
+	t.Setenv("HEARTBEAT_INTERVAL", "50ms")
+	t.Setenv("HEARTBEAT_TIMEOUT", "150ms")
+	url := newTestServer(t)
+	identify := IdentifyRequest{Client: ClientInfo{Name: "nino"}}
+
+	// A bot that stops reading doesn't answer pings either, so it's dropped
+	silent := dialTestServer(t, url, "writer")
+	if err := sendMessage(silent, Identify, identify); err != nil {
+		t.Fatalf("Unable to identify: %v", err)
+	}
+
+	if msg, err := readMessage(silent); err != nil || msg.OP != Ready {
+		t.Fatalf("Reply = %+v, %v, want Ready", msg, err)
+	}
+
+	if !waitFor(func() bool { return Server.ClientFor(testGuildId) == nil }) {
+		t.Fatalf("Client is still registered after missing its heartbeats")
+	}
+
+	// Applied while the shard is away, so it's replayed once it's back
+	claimed, err := Store.Claim("a", 200, "delivery", 1000)
+	if err != nil || claimed == nil {
+		t.Fatalf("Claim() = %v, %v", claimed, err)
+	}
+
+	Server.Dispatch(Delivery{Timeout: *claimed, DeliveryId: "delivery", Attempt: 1})
+
+	conn := dialTestServer(t, url, "writer")
+	if err := sendMessage(conn, Identify, identify); err != nil {
+		t.Fatalf("Unable to identify: %v", err)
+	}
+
+	if msg, err := readMessage(conn); err != nil || msg.OP != Ready {
+		t.Fatalf("Reply = %+v, %v, want Ready", msg, err)
+	}
+
+	msg, err := readMessage(conn)
+	if err != nil || msg.OP != Apply {
+		t.Fatalf("Event = %+v, %v, want the replayed Apply", msg, err)
+	}
+
+	var delivery Delivery
+	if err := json.Unmarshal(msg.Data, &delivery); err != nil || delivery.DeliveryId != "delivery" || delivery.Id != "a" {
+		t.Errorf("Apply = %s, want delivery of a", msg.Data)
+	}
+
+	// Reading answers the pings, which keeps the bot connected without heartbeats
+	_ = conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatalf("Received another message, want nothing")
+	}
+
+	if Server.ClientFor(testGuildId) == nil {
+		t.Errorf("Client that answers pings was dropped")
+	}
+}
@@ -21,32 +21,248 @@
 package pkg
 
 import (
-	"context"
-	"encoding/json"
-	"github.com/go-redis/redis/v8"
+	"errors"
+	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
+	"net"
 	"net/http"
 	"os"
+	"sort"
 	"sync"
 	"time"
 )
 
 type WebSocketServer struct {
-	upgrader websocket.Upgrader
-	mutex    *sync.Mutex
-	Queue    []Timeout
-	client   *Client
+	upgrader          websocket.Upgrader
+	mutex             *sync.Mutex
+	clients           map[int]*Client
+	sessions          map[string]*Session
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+	identifyTimeout   time.Duration
+	handshakeAuth     bool
+	sessionBuffer     int
+	sessionTimeout    time.Duration
+	sendQueue         int
 }
 
 func (s *WebSocketServer) HasClient() bool {
-	return s.client == nil
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.clients) > 0
+}
+
+// QueueIn adds the delivery to the replay queue in the store, so it survives until its
+// shard connects again even if we crash in the meantime. It isn't redelivered while it
+// is queued.
+func (s *WebSocketServer) QueueIn(t Delivery) {
+	if err := Store.Enqueue(t.DeliveryId); err != nil {
+		logrus.Errorf("Unable to queue delivery %s for replay, it'll be redelivered later: %v", t.DeliveryId, err)
+	}
+}
+
+// ClientFor returns the connected client for the shard that owns the guild, if any.
+func (s *WebSocketServer) ClientFor(guildId string) *Client {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, client := range s.clients {
+		if client.Owns(guildId) {
+			return client
+		}
+	}
+
+	return nil
+}
+
+// Dispatch hands an `Apply` for the given delivery to the shard that owns its guild,
+// without waiting on the network, or queues it to be replayed once that shard connects.
+func (s *WebSocketServer) Dispatch(t Delivery) {
+	client := s.ClientFor(t.GuildId)
+	if client == nil {
+		s.QueueIn(t)
+		logrus.Warnf("Shard for guild %s is disconnected, added pending timeout to replay soon.", t.GuildId)
+
+		return
+	}
+
+	client.Deliver(t)
+}
+
+// ClientStats returns the metadata of every connected client, ordered by shard.
+func (s *WebSocketServer) ClientStats() []ClientStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats := make([]ClientStats, 0, len(s.clients))
+	for _, client := range s.clients {
+		stats = append(stats, client.Stats())
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].ShardId < stats[j].ShardId
+	})
+
+	return stats
+}
+
+func (s *WebSocketServer) addClient(client *Client) {
+	s.mutex.Lock()
+	old := s.clients[client.ShardId]
+	s.clients[client.ShardId] = client
+	s.mutex.Unlock()
+
+	if old != nil {
+		logrus.Warnf("Shard #%d connected again, dropping the old connection", client.ShardId)
+		_ = old.Conn.Close()
+	}
+}
+
+func (s *WebSocketServer) removeClient(client *Client) {
+	s.mutex.Lock()
+	if s.clients[client.ShardId] == client {
+		delete(s.clients, client.ShardId)
+	}
+	s.mutex.Unlock()
+
+	client.Session().detach(client)
+}
+
+// createSession starts a new session for the client, and forgets sessions that
+// were disconnected for too long to be resumed. Sessions are checked without holding
+// the server's mutex, since they may be busy writing.
+func (s *WebSocketServer) createSession(client *Client) *Session {
+	session := newSession(client, s.sessionBuffer)
+
+	s.mutex.Lock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, other := range s.sessions {
+		sessions = append(sessions, other)
+	}
+
+	s.mutex.Unlock()
+
+	var expired []*Session
+	for _, other := range sessions {
+		if other.expired(s.sessionTimeout) {
+			expired = append(expired, other)
+		}
+	}
+
+	s.mutex.Lock()
+	for _, other := range expired {
+		if s.sessions[other.Id] == other {
+			delete(s.sessions, other.Id)
+		}
+	}
+
+	s.sessions[session.Id] = session
+	s.mutex.Unlock()
+
+	client.setSession(session)
+	return session
 }
 
-func (s *WebSocketServer) QueueIn(t Timeout) {
+// resume moves the client over to a previous session, taking over its shard, and
+// replays the events it missed.
+func (s *WebSocketServer) resume(client *Client, req ResumeRequest) (int, bool) {
 	s.mutex.Lock()
-	s.Queue = append(s.Queue, t)
+	session, ok := s.sessions[req.SessionId]
 	s.mutex.Unlock()
+
+	if !ok || session.expired(s.sessionTimeout) {
+		return 0, false
+	}
+
+	// Otherwise anyone who learns the session id could take over the shard's events
+	if client.Token == nil || client.Token.Name != session.Token {
+		logrus.Warnf("Client from %s tried to resume session %s of another token", client.RemoteAddr, req.SessionId)
+		return 0, false
+	}
+
+	// Attach first, so no events get lost between replaying and registering the client
+	client.ShardId = session.ShardId
+	client.ShardCount = session.ShardCount
+	client.Name = session.Name
+	client.Version = session.Version
+	client.Capabilities = session.Capabilities
+	client.setSession(session)
+
+	replayed, ok := session.Resume(client, req.LastSeq)
+	if !ok {
+		client.setSession(nil)
+		return 0, false
+	}
+
+	return replayed, true
+}
+
+// replay sends every queued delivery the client's shard owns in order, and keeps
+// the rest queued for the other shards.
+func (s *WebSocketServer) replay(client *Client) {
+	replayed := s.replayQueue(func(guildId string) *Client {
+		if client.Owns(guildId) {
+			return client
+		}
+
+		return nil
+	})
+
+	if replayed > 0 {
+		logrus.Infof("Replayed %d events to shard #%d", replayed, client.ShardId)
+	}
+}
+
+// ReplayQueued sends the queued deliveries of every shard connected to us. Besides the
+// deliveries of shards that were away, this picks up the timeouts that another instance
+// claimed while the shard is connected to us.
+func (s *WebSocketServer) ReplayQueued() {
+	if !s.HasClient() {
+		return
+	}
+
+	if queued, err := Store.QueueLength(); err != nil || queued == 0 {
+		return
+	}
+
+	if replayed := s.replayQueue(s.ClientFor); replayed > 0 {
+		logrus.Infof("Replayed %d queued events", replayed)
+	}
+}
+
+// replayQueue sends the queued deliveries in order to the client `owner` returns for
+// their guild, if any, and returns how many were sent.
+func (s *WebSocketServer) replayQueue(owner func(guildId string) *Client) int {
+	deliveries, err := Store.Queued()
+	if err != nil {
+		if !errors.Is(err, ErrStoreUnavailable) {
+			logrus.Errorf("Unable to retrieve the replay queue: %v", err)
+		}
+
+		return 0
+	}
+
+	replayed := 0
+	for _, delivery := range deliveries {
+		client := owner(delivery.GuildId)
+		if client == nil {
+			continue
+		}
+
+		// Make sure another connection of this shard didn't replay it already
+		deadline := time.Now().Add(Scheduler.ackDeadline).UnixMilli()
+		removed, err := Store.Dequeue(delivery.DeliveryId, deadline)
+		if err != nil || !removed {
+			continue
+		}
+
+		client.Deliver(delivery)
+		replayed++
+	}
+
+	return replayed
 }
 
 var (
@@ -59,95 +275,179 @@ func NewServer() {
 		panic("Attempt to initialise another server instance!")
 	}
 
+	interval := envPositiveDuration("HEARTBEAT_INTERVAL", 30*time.Second)
 	Server = &WebSocketServer{
-		upgrader: websocket.Upgrader{},
-		Queue:    []Timeout{},
-		mutex:    &sync.Mutex{},
-		client:   nil,
+		upgrader: websocket.Upgrader{
+			// permessage-deflate is used when the client asks for it
+			EnableCompression: os.Getenv("PERMESSAGE_DEFLATE") != "false",
+			CheckOrigin: func(req *http.Request) bool {
+				return Access.AllowedOrigin(req)
+			},
+		},
+		mutex:             &sync.Mutex{},
+		clients:           map[int]*Client{},
+		sessions:          map[string]*Session{},
+		heartbeatInterval: interval,
+		heartbeatTimeout:  envPositiveDuration("HEARTBEAT_TIMEOUT", 2*interval),
+		identifyTimeout:   envPositiveDuration("IDENTIFY_TIMEOUT", 30*time.Second),
+		handshakeAuth:     os.Getenv("HANDSHAKE_AUTH") == "true",
+		sessionBuffer:     envPositiveInt("SESSION_BUFFER_SIZE", 1000),
+		sessionTimeout:    envDuration("SESSION_TIMEOUT", 5*time.Minute),
+		sendQueue:         envPositiveInt("SEND_QUEUE_SIZE", 1000),
 	}
+}
 
-	// Overwrite queue based off Redis
-	data, err := Redis.Connection.Get(context.TODO(), "nino:timeouts").Result()
+func HandleRequest(w http.ResponseWriter, req *http.Request) {
+	// Everything is checked before upgrading, so bad clients get a proper HTTP error. The
+	// rate limit comes before the token, so it also limits how fast tokens can be guessed.
+	if !admitted(w, req) {
+		return
+	}
+
+	encoding, err := encodingFor(req)
 	if err != nil {
-		if err == redis.Nil {
-			logrus.Warnf("We have retrieved `null` when fetching for timeouts, skipping as empty queue.")
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
-			// Set it to an empty array
-			err = Redis.Connection.HMSet(context.TODO(), "nino:timeouts", []Timeout{}).Err()
-			if err != nil {
-				logrus.Errorf("Unable to set data as an empty array. :<")
-				return
-			}
+	ip := Access.ClientIP(req)
+	if ok, reason := Access.Connect(ip); !ok {
+		Access.Reject(reason)
+		logrus.Warnf("Rejected connection from %s (%s)", ip, reason)
+		writeError(w, http.StatusTooManyRequests, newError(ErrorRateLimited, "", "Too many connections"))
 
-			logrus.Infof("Queue has been set in Redis, now starting fresh!")
-			Server.Queue = make([]Timeout, 0)
-			return
-		} else {
-			logrus.Warnf("Unable to retrieve all timeouts, are we connected?\n%v", err)
-			return
-		}
+		return
 	}
 
-	// serialize output to []Timeout{}
-	mappedData := make([]Timeout, 0)
-	err = json.Unmarshal([]byte(data), &mappedData)
-	if err != nil {
-		panic(err)
-	}
+	// With `HANDSHAKE_AUTH`, clients that can't set headers can connect without a token
+	// and send it in `Identify` or `Resume` before `IDENTIFY_TIMEOUT`
+	token, secret := requestToken(req)
+	if token == nil && (secret != "" || !Server.handshakeAuth) {
+		Access.Disconnect(ip)
+		rejectAuth(w, req, secret)
 
-	Server.Queue = mappedData
-}
+		return
+	}
 
-func HandleRequest(w http.ResponseWriter, req *http.Request) {
 	conn, err := Server.upgrader.Upgrade(w, req, nil)
 	if err != nil {
+		Access.Disconnect(ip)
+		Access.Reject("upgrade")
 		logrus.Errorf("Unable to upgrade WebSocket: %v", err)
+
 		return
 	}
 
-	if req.Header.Get(authHeader) == "" || req.Header.Get(authHeader) != os.Getenv("AUTH") {
-		logrus.Warnf("Tried to connect client, but received bad authentication key (header=%s)", req.Header.Get(authHeader))
-		_ = conn.Close()
-		return
+	client := &Client{
+		Conn:        conn,
+		ShardCount:  1,
+		RemoteAddr:  ip,
+		connectedAs: token,
+		encoding:    encoding,
+		limiter:     Access.MessageLimiter(),
+		writeLock:   &sync.Mutex{},
+		done:        make(chan struct{}),
+		deliveries:  make(chan Delivery, Server.sendQueue),
+		stateLock:   &sync.Mutex{},
 	}
 
-	Server.client = &Client{
-		Conn:      conn,
-		writeLock: &sync.Mutex{},
+	conn.SetReadLimit(maxDecompressedSize)
+
+	// No need to compress twice
+	if encoding.Compress {
+		conn.EnableWriteCompression(false)
 	}
 
-	Server.client.WriteMessage(Message{OP: Ready})
+	client.keepAlive()
+	conn.SetPongHandler(func(string) error {
+		client.keepAlive()
+		return nil
+	})
+
+	_ = client.WriteMessage(Message{
+		OP:   Hello,
+		Data: HelloData{HeartbeatInterval: Server.heartbeatInterval.Milliseconds()},
+	})
+
+	// Drop clients that never identify
+	identifyTimer := time.AfterFunc(Server.identifyTimeout, func() {
+		if !client.Identified() {
+			logrus.Warnf("Client from %s didn't identify in time, closing connection", ip)
+			_ = conn.Close()
+		}
+	})
+
+	// Everything the client runs in the background, which has stopped by the time its
+	// connection is released
+	workers := &sync.WaitGroup{}
+	workers.Add(2)
 	go func() {
-		for {
-			if Server.client == nil {
-				break
+		defer workers.Done()
+		client.ping()
+	}()
+
+	go func() {
+		defer workers.Done()
+		client.deliver()
+	}()
+
+	go func() {
+		defer func() {
+			identifyTimer.Stop()
+			close(client.done)
+			_ = conn.Close()
+
+			if client.Identified() {
+				Server.removeClient(client)
 			}
 
+			// The connection only counts as closed once the client is gone
+			workers.Wait()
+			Access.Disconnect(ip)
+		}()
+
+		for {
 			s := time.Now()
-			var message Message
-			err := conn.ReadJSON(&message)
+			_, data, err := conn.ReadMessage()
 			if err != nil {
-				Server.client = nil
-				if websocket.IsCloseError(err, websocket.CloseAbnormalClosure, websocket.CloseGoingAway, websocket.CloseInternalServerErr) {
-					logrus.Info("Received disconnect from bot, will replay events once it is back...")
-					break
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					logrus.Warnf("Shard #%d missed its heartbeats, will replay events once it is back...", client.ShardId)
+				} else if websocket.IsCloseError(err, websocket.CloseAbnormalClosure, websocket.CloseGoingAway, websocket.CloseInternalServerErr) {
+					logrus.Infof("Received disconnect from shard #%d, will replay events once it is back...", client.ShardId)
+				} else {
+					logrus.Warnf("Lost connection to shard #%d, will replay events once it is back: %v", client.ShardId, err)
 				}
+
+				return
 			}
 
-			if len(Server.Queue) > 0 {
-				// Replay lost events
-				for _, event := range Server.Queue {
-					Server.client.WriteMessage(Message{
-						OP:   Apply,
-						Data: event,
-					})
-				}
+			client.keepAlive()
+
+			var message Message
+			if err := client.encoding.Decode(data, &message); err != nil {
+				client.WriteError(Message{}, newError(ErrorInvalidMessage, "", fmt.Sprintf("Unable to decode message: %v", err)))
+				continue
+			}
+
+			if !client.limiter.Allow() {
+				Access.Reject("message_rate")
+				client.WriteError(message, newError(ErrorRateLimited, "", "You are sending messages too quickly"))
+
+				continue
+			}
 
-				// Drop old queue
-				Server.Queue = []Timeout{}
+			// The handshake is handled in order, before anything else
+			if !client.Identified() {
+				client.HandleHandshake(message)
+				continue
 			}
 
-			go Server.client.HandleMessage(message, s)
+			workers.Add(1)
+			go func(message Message, s time.Time) {
+				defer workers.Done()
+				client.HandleMessage(message, s)
+			}(message, s)
 		}
 	}()
 }
@@ -0,0 +1,247 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	StorageRedis  = "redis"
+	StorageMemory = "memory"
+	StorageBolt   = "bolt"
+)
+
+// TimeoutStore keeps the pending timeouts, ordered by when they expire, and the deliveries
+// of expired timeouts until the bot acknowledges them. Every method has to be safe to call
+// concurrently, and the ones that move timeouts around have to be atomic, since several
+// instances of the service can share a store.
+type TimeoutStore interface {
+	// Store saves the timeout and schedules it at its `ExpiresAt`. If the user already has
+	// a timeout of the same type in the guild, it is replaced and keeps its id. It returns
+	// the stored timeout, and if it replaced one.
+	Store(t Timeout) (Timeout, bool, error)
+
+	// Get returns the pending timeout with the given id, or `nil` if there isn't one.
+	Get(id string) (*Timeout, error)
+
+	// Find returns every pending timeout matching all filters of the query that were
+	// given, in no particular order. The offset and limit are ignored.
+	Find(q QueryRequest) ([]Timeout, error)
+
+	// Page returns the page at the offset and limit of the query of the pending timeouts
+	// matching all filters that were given, ordered by when they expire, along with how
+	// many match in total. The offset and limit have to be valid already.
+	Page(q QueryRequest) (QueryResponse, error)
+
+	// Scan calls `fn` with every pending timeout, in batches of about `size` timeouts.
+	Scan(size int, fn func(timeouts []Timeout) error) error
+
+	// Count returns how many timeouts are pending.
+	Count() (int, error)
+
+	// Cancel removes the pending timeout with the given id, and reports if there was one.
+	Cancel(id string) (bool, error)
+
+	// Update atomically replaces the pending timeout with the given id with what `change`
+	// returns. It returns the timeout before and after, or `nil`s if there was no such
+	// timeout or it's being applied right now. Errors of `change` are returned as is.
+	Update(id string, change func(t Timeout) (Timeout, error)) (*Timeout, *Timeout, error)
+
+	// Due returns the ids of up to `limit` timeouts that expired at `now`.
+	Due(now int64, limit int) ([]string, error)
+
+	// Claim moves a due timeout into the pending deliveries with the given id, to be
+	// redelivered after `deadline` unless it is acknowledged. It returns `nil` if the
+	// timeout was already claimed, cancelled or moved into the future.
+	Claim(id string, now int64, deliveryId string, deadline int64) (*Timeout, error)
+
+	// Unacknowledged returns up to `limit` deliveries whose deadline passed.
+	Unacknowledged(now int64, limit int) ([]Delivery, error)
+
+	// Redeliver bumps the attempt of an unacknowledged delivery, and pushes its deadline
+	// back exponentially from `backoff` up to `maxBackoff`. It returns `nil` if the
+	// delivery was acknowledged in the meantime.
+	Redeliver(deliveryId string, now int64, backoff time.Duration, maxBackoff time.Duration) (*Delivery, error)
+
+	// Ack removes a delivery, and reports if it was still pending.
+	Ack(deliveryId string) (bool, error)
+
+	// Enqueue adds a delivery to the end of the replay queue, used while its shard is away.
+	// Queued deliveries aren't redelivered until they're dequeued.
+	Enqueue(deliveryId string) error
+
+	// Queued returns the queued deliveries in order, and forgets the ones that were
+	// acknowledged in the meantime.
+	Queued() ([]Delivery, error)
+
+	// Dequeue removes a delivery from the replay queue and redelivers it after `deadline`
+	// unless it is acknowledged. It reports if it was still queued, so only one connection
+	// replays it.
+	Dequeue(deliveryId string, deadline int64) (bool, error)
+
+	// QueueLength returns how many deliveries are queued.
+	QueueLength() (int, error)
+
+	// Rehydrate rebuilds whatever the store needs to schedule the stored timeouts after a
+	// restart. It returns how many timeouts are pending, and the ids of the ones that
+	// expired while we were down.
+	Rehydrate(now int64) (int, []string, error)
+
+	// Ping checks that the store can be reached.
+	Ping() error
+
+	Close() error
+}
+
+// StorageStats is the state of the store, as shown in `Stats` and the health endpoint.
+type StorageStats struct {
+	Backend       string `json:"backend"`
+	Degraded      bool   `json:"degraded"`
+	DegradedSince int64  `json:"degraded_since,omitempty"`
+	Buffered      int    `json:"buffered_writes"`
+	Error         string `json:"error,omitempty"`
+}
+
+var (
+	Store          TimeoutStore
+	storageBackend string
+)
+
+// NewStore opens the storage backend set in `STORAGE_BACKEND`, which defaults to Redis.
+func NewStore() error {
+	if Store != nil {
+		panic("Attempt to initialise another store!")
+	}
+
+	backend := os.Getenv("STORAGE_BACKEND")
+	if backend == "" {
+		backend = StorageRedis
+	}
+
+	storageBackend = backend
+	logrus.Infof("Using the %s storage backend", backend)
+	switch backend {
+	case StorageRedis:
+		{
+			if err := NewRedis(); err != nil {
+				return err
+			}
+
+			store, err := newBufferedStore(newRedisStore(), envString("WAL_PATH", "timeouts.wal"))
+			if err != nil {
+				return err
+			}
+
+			Store = store
+		}
+
+	case StorageMemory:
+		{
+			logrus.Warn("Timeouts are only kept in memory, and will be lost once we restart!")
+			Store = newMemoryStore()
+		}
+
+	case StorageBolt:
+		{
+			store, err := newBoltStore(envString("BOLT_PATH", "timeouts.db"))
+			if err != nil {
+				return err
+			}
+
+			Store = store
+		}
+
+	default:
+		return fmt.Errorf("unknown storage backend %q, expected redis, memory or bolt", backend)
+	}
+
+	return nil
+}
+
+// StorageStatus returns the state of the store, which is only ever degraded when writes
+// are buffered.
+func StorageStatus() StorageStats {
+	stats := StorageStats{Backend: storageBackend}
+	if buffered, ok := Store.(*BufferedStore); ok {
+		buffered.Status(&stats)
+	}
+
+	return stats
+}
+
+// matches returns if the timeout matches every filter of the query that was given.
+func matches(t Timeout, q QueryRequest) bool {
+	return (q.GuildId == "" || t.GuildId == q.GuildId) &&
+		(q.UserId == "" || t.UserId == q.UserId) &&
+		(q.Type == "" || t.Type == q.Type) &&
+		(q.ModeratorId == "" || t.ModeratorId == q.ModeratorId)
+}
+
+// pageOf sorts the timeouts by when they expire, and returns the page of the query.
+func pageOf(timeouts []Timeout, q QueryRequest) QueryResponse {
+	sort.Slice(timeouts, func(i, j int) bool {
+		if timeouts[i].ExpiresAt == timeouts[j].ExpiresAt {
+			return timeouts[i].Id < timeouts[j].Id
+		}
+
+		return timeouts[i].ExpiresAt < timeouts[j].ExpiresAt
+	})
+
+	total := len(timeouts)
+	start := q.Offset
+	if start > total {
+		start = total
+	}
+
+	end := start + q.Limit
+	if end > total {
+		end = total
+	}
+
+	return QueryResponse{
+		Timeouts: timeouts[start:end],
+		Offset:   q.Offset,
+		Total:    total,
+	}
+}
+
+// queuedDeadline is the deadline of queued deliveries, so they're never redelivered.
+const queuedDeadline = math.MaxInt64
+
+// backoffFor returns the deadline of a delivery's next attempt.
+func backoffFor(now int64, attempt int, backoff time.Duration, maxBackoff time.Duration) int64 {
+	delay := backoff.Milliseconds()
+	for i := 1; i < attempt && delay < maxBackoff.Milliseconds(); i++ {
+		delay *= 2
+	}
+
+	if delay > maxBackoff.Milliseconds() {
+		delay = maxBackoff.Milliseconds()
+	}
+
+	return now + delay
+}
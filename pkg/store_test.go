@@ -0,0 +1,511 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testStores returns constructors for a fresh instance of every store, Redis runs on
+// an in-memory server.
+func testStores() map[string]func(t *testing.T) TimeoutStore {
+	return map[string]func(t *testing.T) TimeoutStore{
+		StorageMemory: func(t *testing.T) TimeoutStore {
+			return newMemoryStore()
+		},
+		StorageBolt: func(t *testing.T) TimeoutStore {
+			store, err := newBoltStore(filepath.Join(t.TempDir(), "timeouts.db"))
+			if err != nil {
+				t.Fatalf("Unable to open the bolt store: %v", err)
+			}
+
+			t.Cleanup(func() {
+				_ = store.Close()
+			})
+
+			return store
+		},
+		StorageRedis: func(t *testing.T) TimeoutStore {
+			store, _ := newTestRedisStore(t)
+			return store
+		},
+	}
+}
+
+func newTestRedisStore(t *testing.T) (*RedisStore, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	return &RedisStore{client: client, keys: newRedisKeys("nino:timeouts", false)}, mr
+}
+
+// forEachStore runs the test against a fresh instance of every store.
+func forEachStore(t *testing.T, test func(t *testing.T, store TimeoutStore)) {
+	for name, open := range testStores() {
+		open := open
+		t.Run(name, func(t *testing.T) {
+			test(t, open(t))
+		})
+	}
+}
+
+func testTimeout(id string, guildId string, userId string, kind string, expiresAt int64) Timeout {
+	return Timeout{
+		Id:          id,
+		Type:        kind,
+		GuildId:     guildId,
+		UserId:      userId,
+		IssuedAt:    1,
+		ExpiresAt:   expiresAt,
+		ModeratorId: "3",
+	}
+}
+
+// unacknowledged returns the ids of the deliveries whose deadline passed at `now`.
+func unacknowledged(t *testing.T, store TimeoutStore, now int64) []string {
+	deliveries, err := store.Unacknowledged(now, 10)
+	if err != nil {
+		t.Fatalf("Unacknowledged() error = %v", err)
+	}
+
+	var ids []string
+	for _, delivery := range deliveries {
+		ids = append(ids, delivery.DeliveryId)
+	}
+
+	return ids
+}
+
+func TestStoreReplacesSameType(t *testing.T) {
+	existing := testTimeout("a", "1", "2", "mute", 100)
+	tests := []struct {
+		name         string
+		timeout      Timeout
+		wantId       string
+		wantReplaced bool
+		wantCount    int
+	}{
+		{"same id", testTimeout("a", "1", "2", "mute", 200), "a", true, 1},
+		{"same type", testTimeout("b", "1", "2", "mute", 200), "a", true, 1},
+		{"other type", testTimeout("b", "1", "2", "ban", 200), "b", false, 2},
+		{"other user", testTimeout("b", "1", "4", "mute", 200), "b", false, 2},
+		{"other guild", testTimeout("b", "5", "2", "mute", 200), "b", false, 2},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, store TimeoutStore) {
+				if _, _, err := store.Store(existing); err != nil {
+					t.Fatalf("Store() error = %v", err)
+				}
+
+				stored, replaced, err := store.Store(test.timeout)
+				if err != nil {
+					t.Fatalf("Store() error = %v", err)
+				}
+
+				if stored.Id != test.wantId || replaced != test.wantReplaced {
+					t.Errorf("Store() = %s, %v, want %s, %v", stored.Id, replaced, test.wantId, test.wantReplaced)
+				}
+
+				if count, _ := store.Count(); count != test.wantCount {
+					t.Errorf("Count() = %d, want %d", count, test.wantCount)
+				}
+
+				got, err := store.Get(test.wantId)
+				if err != nil || got == nil || got.ExpiresAt != test.timeout.ExpiresAt {
+					t.Errorf("Get(%s) = %+v, %v, want the new timeout", test.wantId, got, err)
+				}
+
+				// The replaced timeout can't be found under its old schedule anymore
+				due, _ := store.Due(100, 10)
+				if test.wantReplaced && len(due) != 0 {
+					t.Errorf("Due(100) = %v, want nothing", due)
+				}
+			})
+		})
+	}
+}
+
+func TestStoreUpdateReindexes(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store TimeoutStore) {
+		if _, _, err := store.Store(testTimeout("a", "1", "2", "mute", 100)); err != nil {
+			t.Fatalf("Store() error = %v", err)
+		}
+
+		before, after, err := store.Update("a", func(t Timeout) (Timeout, error) {
+			t.Type = "ban"
+			t.ExpiresAt = 200
+			return t, nil
+		})
+
+		if err != nil || before == nil || after == nil || before.Type != "mute" || after.Type != "ban" {
+			t.Fatalf("Update() = %+v, %+v, %v, want mute to ban", before, after, err)
+		}
+
+		tests := []struct {
+			query QueryRequest
+			want  int
+		}{
+			{QueryRequest{Type: "ban"}, 1},
+			{QueryRequest{Type: "mute"}, 0},
+			{QueryRequest{GuildId: "1", UserId: "2"}, 1},
+		}
+
+		for _, test := range tests {
+			found, err := store.Find(test.query)
+			if err != nil || len(found) != test.want {
+				t.Errorf("Find(%+v) = %v, %v, want %d timeouts", test.query, found, err, test.want)
+			}
+		}
+
+		if due, _ := store.Due(199, 10); len(due) != 0 {
+			t.Errorf("Due(199) = %v, want nothing", due)
+		}
+
+		if due, _ := store.Due(200, 10); !reflect.DeepEqual(due, []string{"a"}) {
+			t.Errorf("Due(200) = %v, want [a]", due)
+		}
+	})
+}
+
+func TestStoreUpdateWhileOthersChange(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store TimeoutStore) {
+		if _, _, err := store.Store(testTimeout("a", "1", "2", "mute", 100)); err != nil {
+			t.Fatalf("Store() error = %v", err)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 200; i++ {
+				id := strconv.Itoa(i)
+				_, _, _ = store.Store(testTimeout(id, "1", id, "ban", 100))
+				_, _ = store.Cancel(id)
+			}
+		}()
+
+		for i := int64(1); i <= 200; i++ {
+			expiresAt := 100 + i
+			_, after, err := store.Update("a", func(t Timeout) (Timeout, error) {
+				t.ExpiresAt = expiresAt
+				return t, nil
+			})
+
+			if err != nil || after == nil || after.ExpiresAt != expiresAt {
+				t.Fatalf("Update() = %+v, %v, want it to expire at %d", after, err, expiresAt)
+			}
+		}
+
+		<-done
+	})
+}
+
+func TestRedisStoreUpdateRetries(t *testing.T) {
+	store, _ := newTestRedisStore(t)
+	if _, _, err := store.Store(testTimeout("a", "1", "2", "mute", 100)); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+
+	// The timeout is changed by someone else after it was read the first time
+	calls := 0
+	before, after, err := store.Update("a", func(t Timeout) (Timeout, error) {
+		calls++
+		if calls == 1 {
+			other := t
+			other.Reason = "changed"
+			if _, _, err := store.Store(other); err != nil {
+				return t, err
+			}
+		}
+
+		t.ExpiresAt = 200
+		return t, nil
+	})
+
+	if err != nil || calls != 2 || before.Reason != "changed" || after.Reason != "changed" || after.ExpiresAt != 200 {
+		t.Fatalf("Update() = %+v, %+v, %v after %d calls, want the change applied on top of the other one", before, after, err, calls)
+	}
+}
+
+func TestStoreCancel(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store TimeoutStore) {
+		for _, timeout := range []Timeout{testTimeout("a", "1", "2", "mute", 100), testTimeout("b", "1", "2", "ban", 100)} {
+			if _, _, err := store.Store(timeout); err != nil {
+				t.Fatalf("Store() error = %v", err)
+			}
+		}
+
+		if cancelled, err := store.Cancel("a"); err != nil || !cancelled {
+			t.Fatalf("Cancel() = %v, %v, want true", cancelled, err)
+		}
+
+		if cancelled, _ := store.Cancel("a"); cancelled {
+			t.Error("Cancel() twice = true, want false")
+		}
+
+		if got, _ := store.Get("a"); got != nil {
+			t.Errorf("Get() after Cancel() = %+v, want nil", got)
+		}
+
+		if found, _ := store.Find(QueryRequest{GuildId: "1", UserId: "2"}); len(found) != 1 || found[0].Id != "b" {
+			t.Errorf("Find() after Cancel() = %v, want [b]", found)
+		}
+
+		if due, _ := store.Due(100, 10); !reflect.DeepEqual(due, []string{"b"}) {
+			t.Errorf("Due(100) after Cancel() = %v, want [b]", due)
+		}
+	})
+}
+
+func TestStorePage(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store TimeoutStore) {
+		timeouts := []Timeout{
+			testTimeout("c", "1", "2", "mute", 300),
+			testTimeout("a", "1", "3", "mute", 100),
+			testTimeout("d", "5", "2", "mute", 50),
+			testTimeout("b", "1", "4", "ban", 200),
+		}
+
+		for _, timeout := range timeouts {
+			if _, _, err := store.Store(timeout); err != nil {
+				t.Fatalf("Store() error = %v", err)
+			}
+		}
+
+		tests := []struct {
+			query     QueryRequest
+			wantIds   []string
+			wantTotal int
+		}{
+			{QueryRequest{Limit: 10}, []string{"d", "a", "b", "c"}, 4},
+			{QueryRequest{GuildId: "1", Limit: 2}, []string{"a", "b"}, 3},
+			{QueryRequest{GuildId: "1", Offset: 2, Limit: 2}, []string{"c"}, 3},
+			{QueryRequest{GuildId: "1", Type: "mute", Limit: 10}, []string{"a", "c"}, 2},
+			{QueryRequest{UserId: "2", Limit: 10}, []string{"d", "c"}, 2},
+			{QueryRequest{ModeratorId: "9", Limit: 10}, nil, 0},
+		}
+
+		for _, test := range tests {
+			page, err := store.Page(test.query)
+			if err != nil {
+				t.Fatalf("Page(%+v) error = %v", test.query, err)
+			}
+
+			var ids []string
+			for _, timeout := range page.Timeouts {
+				ids = append(ids, timeout.Id)
+			}
+
+			if !reflect.DeepEqual(ids, test.wantIds) || page.Total != test.wantTotal {
+				t.Errorf("Page(%+v) = %v of %d, want %v of %d", test.query, ids, page.Total, test.wantIds, test.wantTotal)
+			}
+		}
+	})
+}
+
+func TestStoreClaimAckRedeliver(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store TimeoutStore) {
+		if _, _, err := store.Store(testTimeout("a", "1", "2", "mute", 100)); err != nil {
+			t.Fatalf("Store() error = %v", err)
+		}
+
+		if due, _ := store.Due(99, 10); len(due) != 0 {
+			t.Errorf("Due(99) = %v, want nothing", due)
+		}
+
+		if due, _ := store.Due(100, 10); !reflect.DeepEqual(due, []string{"a"}) {
+			t.Errorf("Due(100) = %v, want [a]", due)
+		}
+
+		if claimed, err := store.Claim("a", 99, "early", 200); claimed != nil || err != nil {
+			t.Errorf("Claim() before it expired = %+v, %v, want nil", claimed, err)
+		}
+
+		claimed, err := store.Claim("a", 100, "d1", 200)
+		if err != nil || claimed == nil || claimed.Id != "a" {
+			t.Fatalf("Claim() = %+v, %v, want timeout a", claimed, err)
+		}
+
+		if again, _ := store.Claim("a", 100, "d2", 200); again != nil {
+			t.Errorf("Claim() twice = %+v, want nil", again)
+		}
+
+		if got, _ := store.Get("a"); got != nil {
+			t.Errorf("Get() after Claim() = %+v, want nil", got)
+		}
+
+		if cancelled, _ := store.Cancel("a"); cancelled {
+			t.Error("Cancel() after Claim() = true, want false")
+		}
+
+		if ids := unacknowledged(t, store, 199); len(ids) != 0 {
+			t.Errorf("Unacknowledged(199) = %v, want nothing", ids)
+		}
+
+		if ids := unacknowledged(t, store, 200); !reflect.DeepEqual(ids, []string{"d1"}) {
+			t.Errorf("Unacknowledged(200) = %v, want [d1]", ids)
+		}
+
+		delivery, err := store.Redeliver("d1", 200, 10*time.Millisecond, time.Second)
+		if err != nil || delivery == nil {
+			t.Fatalf("Redeliver() = %+v, %v, want a delivery", delivery, err)
+		}
+
+		if delivery.Attempt != 2 || delivery.DeliveryId != "d1" || delivery.Id != "a" {
+			t.Errorf("Redeliver() = %+v, want attempt 2 of d1 for a", delivery)
+		}
+
+		// The second attempt waits twice the backoff
+		if ids := unacknowledged(t, store, 219); len(ids) != 0 {
+			t.Errorf("Unacknowledged(219) = %v, want nothing", ids)
+		}
+
+		if ids := unacknowledged(t, store, 220); !reflect.DeepEqual(ids, []string{"d1"}) {
+			t.Errorf("Unacknowledged(220) = %v, want [d1]", ids)
+		}
+
+		if acked, _ := store.Ack("d1"); !acked {
+			t.Error("Ack() = false, want true")
+		}
+
+		if acked, _ := store.Ack("d1"); acked {
+			t.Error("Ack() twice = true, want false")
+		}
+
+		if delivery, _ := store.Redeliver("d1", 1000, 10*time.Millisecond, time.Second); delivery != nil {
+			t.Errorf("Redeliver() after Ack() = %+v, want nil", delivery)
+		}
+
+		if ids := unacknowledged(t, store, 1000); len(ids) != 0 {
+			t.Errorf("Unacknowledged(1000) = %v, want nothing", ids)
+		}
+	})
+}
+
+func TestStoreQueue(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store TimeoutStore) {
+		for i, id := range []string{"a", "b", "c"} {
+			if _, _, err := store.Store(testTimeout(id, "1", strconv.Itoa(2+i), "mute", 100)); err != nil {
+				t.Fatalf("Store() error = %v", err)
+			}
+
+			if _, err := store.Claim(id, 100, "d"+id, 200); err != nil {
+				t.Fatalf("Claim() error = %v", err)
+			}
+
+			if err := store.Enqueue("d" + id); err != nil {
+				t.Fatalf("Enqueue() error = %v", err)
+			}
+		}
+
+		if length, _ := store.QueueLength(); length != 3 {
+			t.Errorf("QueueLength() = %d, want 3", length)
+		}
+
+		// Queued deliveries wait for their shard instead of being redelivered
+		if ids := unacknowledged(t, store, 1000); len(ids) != 0 {
+			t.Errorf("Unacknowledged(1000) while queued = %v, want nothing", ids)
+		}
+
+		if _, err := store.Ack("db"); err != nil {
+			t.Fatalf("Ack() error = %v", err)
+		}
+
+		queued, err := store.Queued()
+		if err != nil {
+			t.Fatalf("Queued() error = %v", err)
+		}
+
+		var ids []string
+		for _, delivery := range queued {
+			ids = append(ids, delivery.DeliveryId)
+		}
+
+		if !reflect.DeepEqual(ids, []string{"da", "dc"}) {
+			t.Errorf("Queued() = %v, want [da dc] in order", ids)
+		}
+
+		if removed, _ := store.Dequeue("da", 300); !removed {
+			t.Error("Dequeue() = false, want true")
+		}
+
+		if removed, _ := store.Dequeue("da", 1000); removed {
+			t.Error("Dequeue() twice = true, want false")
+		}
+
+		if length, _ := store.QueueLength(); length != 1 {
+			t.Errorf("QueueLength() = %d, want 1", length)
+		}
+
+		if ids := unacknowledged(t, store, 299); len(ids) != 0 {
+			t.Errorf("Unacknowledged(299) after Dequeue() = %v, want nothing", ids)
+		}
+
+		if ids := unacknowledged(t, store, 300); !reflect.DeepEqual(ids, []string{"da"}) {
+			t.Errorf("Unacknowledged(300) after Dequeue() = %v, want [da]", ids)
+		}
+	})
+}
+
+func TestRedisStoreRehydrate(t *testing.T) {
+	store, mr := newTestRedisStore(t)
+
+	// More than one batch, half of them expired
+	const count = 1200
+	for i := 0; i < count; i++ {
+		timeout := testTimeout(strconv.Itoa(i), "1", strconv.Itoa(i), "mute", int64(i))
+		if _, _, err := store.Store(timeout); err != nil {
+			t.Fatalf("Store() error = %v", err)
+		}
+	}
+
+	// As if the schedule and indexes were lost
+	mr.Del(store.keys.schedule)
+	mr.Del(store.keys.index + "guild:1")
+
+	total, late, err := store.Rehydrate(count/2 - 1)
+	if err != nil {
+		t.Fatalf("Rehydrate() error = %v", err)
+	}
+
+	if total != count || len(late) != count/2 {
+		t.Errorf("Rehydrate() = %d, %d late, want %d, %d late", total, len(late), count, count/2)
+	}
+
+	if due, _ := store.Due(count, count+1); len(due) != count {
+		t.Errorf("Due() after Rehydrate() = %d timeouts, want %d", len(due), count)
+	}
+
+	if page, _ := store.Page(QueryRequest{GuildId: "1", Limit: 1}); page.Total != count {
+		t.Errorf("Page() after Rehydrate() = %d timeouts, want %d", page.Total, count)
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var Certificates *CertificateReloader
+
+// CertificateReloader serves the certificate in `TLS_CERT_FILE` and `TLS_KEY_FILE`, and
+// the client CAs in `TLS_CLIENT_CA_FILE`. The files are checked every `TLS_RELOAD_INTERVAL`
+// and loaded again once they change, so certificates can be renewed without a restart.
+type CertificateReloader struct {
+	certFile   string
+	keyFile    string
+	caFile     string
+	clientAuth tls.ClientAuthType
+
+	mutex       *sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	modified    map[string]time.Time
+}
+
+// NewTLS returns the TLS config for the listener, or `nil` if `TLS_CERT_FILE` isn't set
+// and we should listen in plain text.
+func NewTLS() (*tls.Config, error) {
+	if Certificates != nil {
+		panic("Attempt to initialise another certificate reloader!")
+	}
+
+	certFile := os.Getenv("TLS_CERT_FILE")
+	if certFile == "" {
+		return nil, nil
+	}
+
+	keyFile := os.Getenv("TLS_KEY_FILE")
+	if keyFile == "" {
+		return nil, errors.New("`TLS_KEY_FILE` has to be set along with `TLS_CERT_FILE`")
+	}
+
+	caFile := os.Getenv("TLS_CLIENT_CA_FILE")
+	clientAuth, err := parseClientAuth(os.Getenv("TLS_CLIENT_AUTH"), caFile != "")
+	if err != nil {
+		return nil, err
+	}
+
+	reloader := &CertificateReloader{
+		certFile:   certFile,
+		keyFile:    keyFile,
+		caFile:     caFile,
+		clientAuth: clientAuth,
+		mutex:      &sync.RWMutex{},
+		modified:   map[string]time.Time{},
+	}
+
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+
+	Certificates = reloader
+	go func() {
+		ticker := time.NewTicker(envPositiveDuration("TLS_RELOAD_INTERVAL", 30*time.Second))
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if !Certificates.changed() {
+				continue
+			}
+
+			if err := Certificates.Reload(); err != nil {
+				logrus.Errorf("Unable to reload TLS certificates, keeping the current ones: %v", err)
+			}
+		}
+	}()
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// WebSockets can't be upgraded over HTTP/2
+		NextProtos:         []string{"http/1.1"},
+		GetCertificate:     reloader.getCertificate,
+		GetConfigForClient: reloader.getConfigForClient,
+	}, nil
+}
+
+func parseClientAuth(value string, hasCA bool) (tls.ClientAuthType, error) {
+	switch strings.ToLower(value) {
+	case "":
+		{
+			if hasCA {
+				return tls.VerifyClientCertIfGiven, nil
+			}
+
+			return tls.NoClientCert, nil
+		}
+
+	case "none":
+		return tls.NoClientCert, nil
+
+	case "request", "verify":
+		{
+			if !hasCA {
+				return tls.NoClientCert, errors.New("`TLS_CLIENT_CA_FILE` has to be set to verify client certificates")
+			}
+
+			return tls.VerifyClientCertIfGiven, nil
+		}
+
+	case "require":
+		{
+			if !hasCA {
+				return tls.NoClientCert, errors.New("`TLS_CLIENT_CA_FILE` has to be set to require client certificates")
+			}
+
+			return tls.RequireAndVerifyClientCert, nil
+		}
+
+	default:
+		return tls.NoClientCert, fmt.Errorf("unknown `TLS_CLIENT_AUTH` mode %q, expected none, verify or require", value)
+	}
+}
+
+// Reload loads the certificate and client CAs from disk again.
+func (r *CertificateReloader) Reload() error {
+	modified := map[string]time.Time{}
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+
+		modified[file] = info.ModTime()
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		data, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", r.caFile)
+		}
+	}
+
+	r.mutex.Lock()
+	r.certificate = &certificate
+	r.clientCAs = pool
+	r.modified = modified
+	r.mutex.Unlock()
+
+	logrus.Infof("Loaded TLS certificate from %s", r.certFile)
+	return nil
+}
+
+func (r *CertificateReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.caFile != "" {
+		files = append(files, r.caFile)
+	}
+
+	return files
+}
+
+// changed returns if any of the files were modified since they were last loaded.
+func (r *CertificateReloader) changed() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			// Probably being replaced right now, try again on the next tick
+			continue
+		}
+
+		if !info.ModTime().Equal(r.modified[file]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *CertificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.certificate, nil
+}
+
+// getConfigForClient builds the config of every connection, so reloaded client CAs
+// are used right away.
+func (r *CertificateReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"http/1.1"},
+		GetCertificate: r.getCertificate,
+		ClientAuth:     r.clientAuth,
+		ClientCAs:      r.clientCAs,
+	}, nil
+}
+
+// peerCertificate returns the verified client certificate of the request, if any.
+func peerCertificate(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return req.TLS.VerifiedChains[0][0]
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate for the name and its key to the
+// files, and moves their modification time forward so the change is noticed.
+func writeTestCertificate(t *testing.T, certFile string, keyFile string, name string, modified time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unable to create certificate: %v", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Unable to marshal key: %v", err)
+	}
+
+	writeTestFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), modified)
+	writeTestFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), modified)
+}
+
+func writeTestFile(t *testing.T, file string, data []byte, modified time.Time) {
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("Unable to write %s: %v", file, err)
+	}
+
+	if err := os.Chtimes(file, modified, modified); err != nil {
+		t.Fatalf("Unable to touch %s: %v", file, err)
+	}
+}
+
+// servedName returns the common name of the certificate the reloader serves.
+func servedName(t *testing.T, r *CertificateReloader) string {
+	certificate, err := r.getCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("getCertificate() error = %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatalf("Unable to parse the served certificate: %v", err)
+	}
+
+	return leaf.Subject.CommonName
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	now := time.Now()
+	writeTestCertificate(t, certFile, keyFile, "first", now.Add(-time.Hour))
+
+	r := &CertificateReloader{certFile: certFile, keyFile: keyFile, mutex: &sync.RWMutex{}, modified: map[string]time.Time{}}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	if r.changed() {
+		t.Errorf("changed() = true right after loading")
+	}
+
+	// A renewed pair is picked up
+	writeTestCertificate(t, certFile, keyFile, "second", now.Add(-time.Minute))
+	if !r.changed() {
+		t.Fatalf("changed() = false after the pair was rewritten")
+	}
+
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	if name := servedName(t, r); name != "second" {
+		t.Errorf("served certificate = %q after reloading, want second", name)
+	}
+
+	// A broken pair, like a key that was written before its certificate, keeps the old one
+	writeTestFile(t, keyFile, []byte("not a key"), now)
+	if !r.changed() {
+		t.Fatalf("changed() = false after the key was rewritten")
+	}
+
+	if err := r.Reload(); err == nil {
+		t.Errorf("Reload() with a broken key succeeded")
+	}
+
+	if name := servedName(t, r); name != "second" {
+		t.Errorf("served certificate = %q after a failed reload, want second", name)
+	}
+}
+
+func TestParseClientAuth(t *testing.T) {
+	tests := []struct {
+		value   string
+		hasCA   bool
+		want    tls.ClientAuthType
+		wantErr bool
+	}{
+		{"", false, tls.NoClientCert, false},
+		{"", true, tls.VerifyClientCertIfGiven, false},
+		{"none", false, tls.NoClientCert, false},
+		{"none", true, tls.NoClientCert, false},
+		{"request", true, tls.VerifyClientCertIfGiven, false},
+		{"request", false, tls.NoClientCert, true},
+		{"verify", true, tls.VerifyClientCertIfGiven, false},
+		{"verify", false, tls.NoClientCert, true},
+		{"VERIFY", true, tls.VerifyClientCertIfGiven, false},
+		{"require", true, tls.RequireAndVerifyClientCert, false},
+		{"require", false, tls.NoClientCert, true},
+		{"always", true, tls.NoClientCert, true},
+	}
+
+	for _, test := range tests {
+		got, err := parseClientAuth(test.value, test.hasCA)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseClientAuth(%q, %v) error = %v, want error %v", test.value, test.hasCA, err, test.wantErr)
+		}
+
+		if got != test.want {
+			t.Errorf("parseClientAuth(%q, %v) = %v, want %v", test.value, test.hasCA, got, test.want)
+		}
+	}
+}
@@ -20,6 +20,8 @@
 
 package pkg
 
+import "fmt"
+
 type OperationType int
 
 const (
@@ -28,14 +30,35 @@ const (
 	Request
 	RequestAll
 	Stats
+	Cancel
+	Update
+	Ack
+	Query
+	Error
+	Created
+	Hello
+	Heartbeat
+	HeartbeatAck
+	Resume
+	Resumed
+	InvalidSession
+	Identify
 )
 
+// Message is a single frame sent over the WebSocket. The optional nonce of a request
+// is echoed back in every response to it, so concurrent requests can be told apart.
+//
+// Events the server sends on its own (like `Apply`) have an increasing sequence number,
+// which is used to resume the session after reconnecting.
 type Message struct {
-	OP   OperationType `json:"op"`
-	Data interface{}   `json:"d"`
+	OP    OperationType `json:"op"`
+	Data  interface{}   `json:"d"`
+	Nonce string        `json:"nonce,omitempty"`
+	Seq   int64         `json:"s,omitempty"`
 }
 
 type Timeout struct {
+	Id          string `json:"id,omitempty"`
 	Type        string `json:"type"`
 	GuildId     string `json:"guild_id"`
 	UserId      string `json:"user_id"`
@@ -45,6 +68,160 @@ type Timeout struct {
 	Reason      string `json:"reason,omitempty"`
 }
 
+// Delivery is the payload of an `Apply` operation. The bot has to acknowledge it
+// with an `Ack` containing the delivery id, otherwise it'll be redelivered.
+type Delivery struct {
+	Timeout
+	DeliveryId string `json:"delivery_id"`
+	Attempt    int    `json:"attempt"`
+}
+
+type AckRequest struct {
+	DeliveryId string `json:"delivery_id"`
+}
+
+// CancelRequest is the payload of a `Cancel` operation, the response echoes it
+// back with whether a pending timeout was actually cancelled. Timeouts are either
+// cancelled by their id, or by the guild, user and (optionally) type.
+type CancelRequest struct {
+	Id      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	GuildId string `json:"guild_id"`
+	UserId  string `json:"user_id"`
+}
+
+type CancelResponse struct {
+	CancelRequest
+	Cancelled bool `json:"cancelled"`
+}
+
+// UpdateRequest is the payload of an `Update` operation, which moves the expiry of
+// an existing timeout. The timeout is looked up by its id, or by the guild, user and
+// type. The reason is left untouched if it isn't given.
+type UpdateRequest struct {
+	Id        string  `json:"id,omitempty"`
+	Type      string  `json:"type"`
+	GuildId   string  `json:"guild_id"`
+	UserId    string  `json:"user_id"`
+	ExpiresAt int64   `json:"expires_at"`
+	Reason    *string `json:"reason,omitempty"`
+}
+
+// UpdateResponse holds the timeout before and after an update, both are `null`
+// if there was no pending timeout to update.
+type UpdateResponse struct {
+	Before *Timeout `json:"before"`
+	After  *Timeout `json:"after"`
+}
+
+// QueryRequest is the payload of a `Query` operation. Every filter is optional,
+// and only timeouts matching all given filters are returned.
+type QueryRequest struct {
+	GuildId     string `json:"guild_id,omitempty"`
+	UserId      string `json:"user_id,omitempty"`
+	Type        string `json:"type,omitempty"`
+	ModeratorId string `json:"moderator_id,omitempty"`
+	Offset      int    `json:"offset,omitempty"`
+	Limit       int    `json:"limit,omitempty"`
+}
+
+type QueryResponse struct {
+	Timeouts []Timeout `json:"timeouts"`
+	Offset   int       `json:"offset"`
+	Total    int       `json:"total"`
+}
+
+// TimeoutChunk is one chunk of the response to `RequestAll`, which is sent in as many
+// chunks as needed. `chunk_count` is an estimate until the last chunk, which always has
+// `chunk_index == chunk_count - 1`.
+type TimeoutChunk struct {
+	Timeouts   []Timeout `json:"timeouts"`
+	ChunkIndex int       `json:"chunk_index"`
+	ChunkCount int       `json:"chunk_count"`
+	Total      int       `json:"total"`
+}
+
+// HelloData is the payload of the `Hello` operation sent right after connecting. The
+// bot should send a `Heartbeat` every `heartbeat_interval` milliseconds, or it will be
+// considered disconnected.
+type HelloData struct {
+	HeartbeatInterval int64 `json:"heartbeat_interval"`
+}
+
+// ReadyData is the payload of the `Ready` operation, the session id can be used to
+// resume the session after reconnecting.
+type ReadyData struct {
+	SessionId    string   `json:"session_id"`
+	ShardId      int      `json:"shard_id"`
+	ShardCount   int      `json:"shard_count"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// IdentifyRequest is the payload of the `Identify` operation, which has to be the first
+// message after `Hello` (unless resuming). `shard` is `[shard_id, shard_count]` and
+// defaults to `[0, 1]`. The token can be left out if it was sent in the `Authorization`
+// header instead.
+type IdentifyRequest struct {
+	Token        string     `json:"token,omitempty"`
+	Client       ClientInfo `json:"client"`
+	Shard        []int      `json:"shard,omitempty"`
+	Capabilities []string   `json:"capabilities,omitempty"`
+}
+
+type ClientInfo struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// ClientStats is the metadata of a connected client, as shown in `Stats`.
+type ClientStats struct {
+	Name         string   `json:"name"`
+	Version      string   `json:"version"`
+	ShardId      int      `json:"shard_id"`
+	ShardCount   int      `json:"shard_count"`
+	Capabilities []string `json:"capabilities"`
+	Token        string   `json:"token"`
+	Encoding     string   `json:"encoding"`
+	Compress     bool     `json:"compress"`
+	RemoteAddr   string   `json:"remote_addr"`
+	ConnectedAt  int64    `json:"connected_at"`
+}
+
+// ResumeRequest is the payload of a `Resume` operation, which can be sent instead of
+// `Identify` to replay every event after `last_seq` of a previous session. It is
+// answered with `Resumed`, or with `InvalidSession` if the session can't be resumed.
+type ResumeRequest struct {
+	Token     string `json:"token,omitempty"`
+	SessionId string `json:"session_id"`
+	LastSeq   int64  `json:"last_seq"`
+}
+
+type ResumedData struct {
+	SessionId string `json:"session_id"`
+	Replayed  int    `json:"replayed"`
+}
+
+// TimeoutRequest is the payload of a `Request` operation. Older bots send the
+// moderator as `moderator` instead of `moderator_id`.
+type TimeoutRequest struct {
+	Timeout
+	Moderator string `json:"moderator,omitempty"`
+}
+
+type ErrorCode string
+
+// ErrorResponse is sent as the payload of an `Error` operation, and as the body of
+// failed REST requests. `Field` is the offending field of the payload, if any.
 type ErrorResponse struct {
-	Message string `json:"message"`
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	Field   string    `json:"field,omitempty"`
+}
+
+func (e ErrorResponse) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("%s (%s): %s", e.Code, e.Field, e.Message)
+	}
+
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
 }
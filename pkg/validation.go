@@ -0,0 +1,231 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	ErrorInvalidMessage   ErrorCode = "INVALID_MESSAGE"
+	ErrorUnknownOperation ErrorCode = "UNKNOWN_OPERATION"
+	ErrorInvalidPayload   ErrorCode = "INVALID_PAYLOAD"
+	ErrorInvalidField     ErrorCode = "INVALID_FIELD"
+	ErrorUnauthorized     ErrorCode = "UNAUTHORIZED"
+	ErrorForbidden        ErrorCode = "FORBIDDEN"
+	ErrorRateLimited      ErrorCode = "RATE_LIMITED"
+	ErrorUnavailable      ErrorCode = "STORE_UNAVAILABLE"
+	ErrorBuffered         ErrorCode = "WRITE_BUFFERED"
+	ErrorNotFound         ErrorCode = "NOT_FOUND"
+	ErrorMethodNotAllowed ErrorCode = "METHOD_NOT_ALLOWED"
+	ErrorInternal         ErrorCode = "INTERNAL_ERROR"
+)
+
+func newError(code ErrorCode, field string, message string) ErrorResponse {
+	return ErrorResponse{
+		Code:    code,
+		Message: message,
+		Field:   field,
+	}
+}
+
+// toErrorResponse converts any error into something we can send back, errors that
+// aren't an `ErrorResponse` already are treated as internal errors.
+func toErrorResponse(err error) ErrorResponse {
+	var res ErrorResponse
+	if errors.As(err, &res) {
+		return res
+	}
+
+	if errors.Is(err, ErrWriteBuffered) {
+		return newError(ErrorBuffered, "", "Storage is unavailable, the write was accepted and will be applied once it's back")
+	}
+
+	if errors.Is(err, ErrStoreUnavailable) {
+		return newError(ErrorUnavailable, "", "Storage is unavailable, try again later")
+	}
+
+	return newError(ErrorInternal, "", "Internal error, try again later")
+}
+
+// decodeData decodes the `d` of a message into the given payload, rejecting unknown
+// fields and fields with the wrong type.
+func decodeData(data interface{}, v interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return newError(ErrorInvalidPayload, "", "Unable to encode payload")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return newError(ErrorInvalidField, typeErr.Field, fmt.Sprintf("Expected `%s` to be a %s, received %s", typeErr.Field, typeErr.Type, typeErr.Value))
+		}
+
+		if strings.HasPrefix(err.Error(), "json: unknown field ") {
+			field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+			return newError(ErrorInvalidField, field, fmt.Sprintf("Unknown field `%s`", field))
+		}
+
+		return newError(ErrorInvalidPayload, "", fmt.Sprintf("Unable to decode payload: %v", err))
+	}
+
+	return nil
+}
+
+func validateSnowflake(field string, value string) error {
+	if value == "" {
+		return newError(ErrorInvalidField, field, fmt.Sprintf("`%s` is required", field))
+	}
+
+	// Snowflakes always have a timestamp in the upper 42 bits
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || id>>22 == 0 {
+		return newError(ErrorInvalidField, field, fmt.Sprintf("`%s` is not a valid snowflake", field))
+	}
+
+	return nil
+}
+
+func validateOptionalSnowflake(field string, value string) error {
+	if value == "" {
+		return nil
+	}
+
+	return validateSnowflake(field, value)
+}
+
+func validateTimeout(t Timeout) error {
+	if t.Type == "" {
+		return newError(ErrorInvalidField, "type", "`type` is required")
+	}
+
+	if err := validateSnowflake("guild_id", t.GuildId); err != nil {
+		return err
+	}
+
+	if err := validateSnowflake("user_id", t.UserId); err != nil {
+		return err
+	}
+
+	if err := validateSnowflake("moderator_id", t.ModeratorId); err != nil {
+		return err
+	}
+
+	if t.IssuedAt <= 0 {
+		return newError(ErrorInvalidField, "issued_at", "`issued_at` must be a positive timestamp")
+	}
+
+	if t.ExpiresAt <= t.IssuedAt {
+		return newError(ErrorInvalidField, "expires_at", "`expires_at` must be after `issued_at`")
+	}
+
+	return nil
+}
+
+func validateCancel(req CancelRequest) error {
+	if req.Id != "" {
+		return nil
+	}
+
+	if err := validateSnowflake("guild_id", req.GuildId); err != nil {
+		return err
+	}
+
+	return validateSnowflake("user_id", req.UserId)
+}
+
+func validateUpdate(req UpdateRequest) error {
+	if req.Id == "" {
+		if err := validateSnowflake("guild_id", req.GuildId); err != nil {
+			return err
+		}
+
+		if err := validateSnowflake("user_id", req.UserId); err != nil {
+			return err
+		}
+	}
+
+	if req.ExpiresAt <= 0 {
+		return newError(ErrorInvalidField, "expires_at", "`expires_at` must be a positive timestamp")
+	}
+
+	return nil
+}
+
+func validateAck(req AckRequest) error {
+	if req.DeliveryId == "" {
+		return newError(ErrorInvalidField, "delivery_id", "`delivery_id` is required")
+	}
+
+	return nil
+}
+
+func validateQuery(req QueryRequest) error {
+	if err := validateOptionalSnowflake("guild_id", req.GuildId); err != nil {
+		return err
+	}
+
+	if err := validateOptionalSnowflake("user_id", req.UserId); err != nil {
+		return err
+	}
+
+	if err := validateOptionalSnowflake("moderator_id", req.ModeratorId); err != nil {
+		return err
+	}
+
+	if req.Offset < 0 {
+		return newError(ErrorInvalidField, "offset", "`offset` can't be negative")
+	}
+
+	if req.Limit < 0 || req.Limit > maxQueryLimit {
+		return newError(ErrorInvalidField, "limit", fmt.Sprintf("`limit` must be between 0 and %d", maxQueryLimit))
+	}
+
+	return nil
+}
+
+func validateIdentify(req IdentifyRequest) error {
+	if req.Client.Name == "" {
+		return newError(ErrorInvalidField, "client.name", "`client.name` is required")
+	}
+
+	if len(req.Shard) == 0 {
+		return nil
+	}
+
+	if len(req.Shard) != 2 {
+		return newError(ErrorInvalidField, "shard", "`shard` must be `[shard_id, shard_count]`")
+	}
+
+	if req.Shard[1] < 1 || req.Shard[0] < 0 || req.Shard[0] >= req.Shard[1] {
+		return newError(ErrorInvalidField, "shard", fmt.Sprintf("Shard #%d is out of range for %d shards", req.Shard[0], req.Shard[1]))
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2021 Nino
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pkg
+
+import (
+	"errors"
+	"testing"
+)
+
+const (
+	testGuildId     = "175928847299117063"
+	testUserId      = "280158289667555328"
+	testModeratorId = "211260587038998528"
+)
+
+func validTimeout() Timeout {
+	return Timeout{
+		Type:        "mute",
+		GuildId:     testGuildId,
+		UserId:      testUserId,
+		IssuedAt:    1652054400000,
+		ExpiresAt:   1652058000000,
+		ModeratorId: testModeratorId,
+	}
+}
+
+// errorField returns the code and field of an `ErrorResponse`, or empty strings for nil.
+func errorField(t *testing.T, err error) (ErrorCode, string) {
+	if err == nil {
+		return "", ""
+	}
+
+	var res ErrorResponse
+	if !errors.As(err, &res) {
+		t.Fatalf("error %v isn't an ErrorResponse", err)
+	}
+
+	return res.Code, res.Field
+}
+
+func TestValidateTimeout(t *testing.T) {
+	tests := []struct {
+		name      string
+		change    func(t *Timeout)
+		wantCode  ErrorCode
+		wantField string
+	}{
+		{"valid", func(t *Timeout) {}, "", ""},
+		{"missing type", func(t *Timeout) { t.Type = "" }, ErrorInvalidField, "type"},
+		{"missing guild", func(t *Timeout) { t.GuildId = "" }, ErrorInvalidField, "guild_id"},
+		{"guild isn't a number", func(t *Timeout) { t.GuildId = "guild" }, ErrorInvalidField, "guild_id"},
+		{"guild without timestamp", func(t *Timeout) { t.GuildId = "12345" }, ErrorInvalidField, "guild_id"},
+		{"invalid user", func(t *Timeout) { t.UserId = "-1" }, ErrorInvalidField, "user_id"},
+		{"missing moderator", func(t *Timeout) { t.ModeratorId = "" }, ErrorInvalidField, "moderator_id"},
+		{"missing issued_at", func(t *Timeout) { t.IssuedAt = 0 }, ErrorInvalidField, "issued_at"},
+		{"expires when issued", func(t *Timeout) { t.ExpiresAt = t.IssuedAt }, ErrorInvalidField, "expires_at"},
+		{"expires before issued", func(t *Timeout) { t.ExpiresAt = t.IssuedAt - 1 }, ErrorInvalidField, "expires_at"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			timeout := validTimeout()
+			test.change(&timeout)
+
+			code, field := errorField(t, validateTimeout(timeout))
+			if code != test.wantCode || field != test.wantField {
+				t.Errorf("validateTimeout() = %q on %q, want %q on %q", code, field, test.wantCode, test.wantField)
+			}
+		})
+	}
+}
+
+func TestDecodeData(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      interface{}
+		wantCode  ErrorCode
+		wantField string
+	}{
+		{"valid", map[string]interface{}{"delivery_id": "abc"}, "", ""},
+		{"empty", map[string]interface{}{}, "", ""},
+		{"unknown field", map[string]interface{}{"delivery_id": "abc", "foo": 1}, ErrorInvalidField, "foo"},
+		{"wrong type", map[string]interface{}{"delivery_id": 5}, ErrorInvalidField, "delivery_id"},
+		{"unencodable", map[string]interface{}{"delivery_id": make(chan int)}, ErrorInvalidPayload, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var req AckRequest
+			code, field := errorField(t, decodeData(test.data, &req))
+			if code != test.wantCode || field != test.wantField {
+				t.Errorf("decodeData() = %q on %q, want %q on %q", code, field, test.wantCode, test.wantField)
+			}
+		})
+	}
+
+	var req AckRequest
+	if err := decodeData(map[string]interface{}{"delivery_id": "abc"}, &req); err != nil || req.DeliveryId != "abc" {
+		t.Errorf("decodeData() = %+v, %v, want delivery abc", req, err)
+	}
+}